@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/SaCavid/simple-task/service"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo"
+	"net/http"
+	"strings"
+)
+
+// roles of bearer token
+const (
+	RoleProvider = "provider" // posts transactions. api key of provider has same role
+	RoleUser     = "user"     // reads own balance and transactions
+	RoleAdmin    = "admin"    // everything except posting transactions
+
+	// echo context key of verified token claims
+	ContextClaims = "claims"
+)
+
+var (
+	errNoCredentials = errors.New("authorization required")
+	errWrongApiKey   = errors.New("wrong api key")
+)
+
+// allows request only for listed roles
+// bearer token (Authorization: Bearer <jwt>) or api key of provider (provider role) must be sent
+func (h *Server) Auth(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+
+			claims, err := h.authenticate(c)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, &models.Response{Error: true, Message: err.Error()})
+			}
+
+			if !hasRole(claims.Role, roles) {
+				return echo.NewHTTPError(http.StatusForbidden, &models.Response{Error: true, Message: "not allowed for " + claims.Role + " role"})
+			}
+
+			c.Set(ContextClaims, claims)
+			return next(c)
+		}
+	}
+}
+
+// user role allowed to read only own data. must be used after Auth
+func (h *Server) OwnUser(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		claims, ok := c.Get(ContextClaims).(*service.Claims)
+		if !ok {
+			return echo.NewHTTPError(http.StatusUnauthorized, &models.Response{Error: true, Message: errNoCredentials.Error()})
+		}
+
+		if claims.Role == RoleUser && claims.Subject != c.Param("id") {
+			return echo.NewHTTPError(http.StatusForbidden, &models.Response{Error: true, Message: "not allowed for other users"})
+		}
+
+		return next(c)
+	}
+}
+
+// claims of api key or bearer token. authenticated provider saved in context
+func (h *Server) authenticate(c echo.Context) (*service.Claims, error) {
+
+	if key := c.Request().Header.Get(HeaderApiKey); key != "" {
+		p, ok := h.provider(models.HashApiKey(key))
+		if !ok || p.Revoked() {
+			return nil, errWrongApiKey
+		}
+
+		c.Set(ContextProvider, p)
+		return &service.Claims{Role: RoleProvider, RegisteredClaims: jwt.RegisteredClaims{Subject: fmt.Sprint(p.ID)}}, nil
+	}
+
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, errNoCredentials
+	}
+
+	if h.Jwt == nil {
+		return nil, fmt.Errorf("bearer tokens not accepted")
+	}
+
+	claims, err := h.Jwt.Verify(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		return nil, fmt.Errorf("wrong token: %v", err)
+	}
+
+	switch claims.Role {
+	case RoleUser, RoleAdmin:
+		if claims.Subject == "" {
+			return nil, fmt.Errorf("token without subject")
+		}
+
+	case RoleProvider:
+		// provider token must belong to active provider. allowed source types and hmac secret of provider used
+		p, ok := h.providerById(claims.Subject)
+		if !ok || p.Revoked() {
+			return nil, fmt.Errorf("unknown or revoked provider")
+		}
+		c.Set(ContextProvider, p)
+
+	default:
+		return nil, fmt.Errorf("unknown role %q", claims.Role)
+	}
+
+	return claims, nil
+}
+
+func hasRole(role string, roles []string) bool {
+	for _, v := range roles {
+		if v == role {
+			return true
+		}
+	}
+
+	return false
+}
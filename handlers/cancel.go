@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/SaCavid/simple-task/service"
+	"github.com/labstack/echo"
+	"net/http"
+)
+
+// @Summary Cancel transaction
+// @Security BearerAuth
+// @Tags transactions
+// @Description reverse processed transaction. same rules as post processing: balance cant be negative, record canceled only once.
+// @Description partial refund with amount. record denied by post processing can be canceled
+// @Accept json
+// @Produce json
+// @Param transactionId path string true "transaction id"
+// @Param input body models.CancelRequest true "amount and reason"
+// @Success 200 {object} models.Response
+// @Failure 400,401,403,404,409 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/admin/transactions/{transactionId}/cancel [post]
+func (h *Server) ManualCancel(c echo.Context) error {
+
+	cr := new(models.CancelRequest)
+	if err := c.Bind(cr); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "bad request"})
+	}
+
+	if cr.Reason == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "reason cant be null"})
+	}
+
+	claims, ok := c.Get(ContextClaims).(*service.Claims)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, &models.Response{Error: true, Message: errNoCredentials.Error()})
+	}
+
+	id := c.Param("transactionId")
+
+	// buffered transaction inserted first. cancel needs record id
+	if _, pending := h.pendingTransaction(id); pending {
+		if err := h.flushBuffered(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+		}
+	}
+
+	data, err := h.Repo.FindTransaction(id)
+	if err == service.ErrNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, &models.Response{Error: true, Message: "transaction not found"})
+	}
+
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	if data.Status != models.StatusProcessed && data.Status != models.StatusCancelDenied {
+		return echo.NewHTTPError(http.StatusConflict, &models.Response{Error: true, Message: "transaction " + data.StatusName() + ". cant be canceled"})
+	}
+
+	cancel := models.NewCancellation(data, cr.Reason, "")
+	cancel.Requester = claims.Subject
+
+	if cr.Amount != "" {
+		cancel.Amount, err = models.ParseMoney(cr.Amount)
+		if err != nil || cancel.Amount == 0 || cancel.Amount > data.Amount {
+			return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "refund amount must be positive and not more than transaction amount"})
+		}
+	}
+
+	switch err := h.cancel(&data, &cancel); err {
+	case nil:
+		return c.JSON(http.StatusOK, &models.Response{Message: "transaction canceled", Data: cancel})
+	case service.ErrNotEnoughBalance:
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "cancel not accepted. balance cant be negative", Data: cancel})
+	case service.ErrAlreadyCanceled:
+		return echo.NewHTTPError(http.StatusConflict, &models.Response{Error: true, Message: "transaction already canceled"})
+	default:
+		if errors.Is(err, service.ErrWALFailed) {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, &models.Response{Error: true, Message: "transaction log unavailable"})
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/SaCavid/simple-task/service"
+	"github.com/robfig/cron/v3"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// CancelPolicy selects transaction records canceled by post processing
+// only processed records of selection canceled. others skipped
+type CancelPolicy interface {
+	// exclude --> source types never canceled by rules
+	Candidates(repo service.Repository, exclude []int) ([]models.Data, error)
+
+	// policy name saved with cancellations
+	String() string
+}
+
+// Schedule returns next post processing time after t. cron.Schedule implements it
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// post processing every d
+type Interval time.Duration
+
+func (d Interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(d))
+}
+
+// selection of latest records with filters
+type FilterPolicy struct {
+	Parity    int           // models.ParityOdd / ParityEven / ParityAny
+	Limit     int           // batch size
+	UserId    string        // only records of user. empty --> all users
+	Source    *int          // only records of source type. nil --> all source types
+	MinAge    time.Duration // only records older than MinAge
+	MaxAge    time.Duration // only records newer than MaxAge. 0 --> no limit
+	MinAmount *models.Money
+	MaxAmount *models.Money
+}
+
+// rule of task. 10 latest odd records
+func DefaultCancelPolicy() *FilterPolicy {
+	return &FilterPolicy{Parity: models.ParityOdd, Limit: 10}
+}
+
+func (p *FilterPolicy) Candidates(repo service.Repository, exclude []int) ([]models.Data, error) {
+
+	f := models.CancelFilter{
+		Parity:    p.Parity,
+		UserId:    p.UserId,
+		Source:    p.Source,
+		Exclude:   exclude,
+		MinAmount: p.MinAmount,
+		MaxAmount: p.MaxAmount,
+		Limit:     p.Limit,
+	}
+
+	now := time.Now()
+	if p.MinAge > 0 {
+		f.To = now.Add(-p.MinAge)
+	}
+
+	if p.MaxAge > 0 {
+		f.From = now.Add(-p.MaxAge)
+	}
+
+	return repo.CancelCandidates(f)
+}
+
+// query string of policy. source type as id
+func (p *FilterPolicy) String() string {
+
+	q := url.Values{}
+	q.Set("parity", [...]string{models.ParityAny: "any", models.ParityOdd: "odd", models.ParityEven: "even"}[p.Parity])
+	q.Set("limit", strconv.Itoa(p.Limit))
+
+	if p.UserId != "" {
+		q.Set("user", p.UserId)
+	}
+
+	if p.Source != nil {
+		q.Set("source", strconv.Itoa(*p.Source))
+	}
+
+	if p.MinAge > 0 {
+		q.Set("min_age", p.MinAge.String())
+	}
+
+	if p.MaxAge > 0 {
+		q.Set("max_age", p.MaxAge.String())
+	}
+
+	if p.MinAmount != nil {
+		q.Set("min_amount", p.MinAmount.String())
+	}
+
+	if p.MaxAmount != nil {
+		q.Set("max_amount", p.MaxAmount.String())
+	}
+
+	return q.Encode()
+}
+
+// policy from query string. not set parameters same as default policy
+// example: parity=even&limit=20&source=game&user=id&min_age=1h&max_age=24h&min_amount=100&max_amount=500
+func ParseCancelPolicy(s string, sources *SourceTypes) (*FilterPolicy, error) {
+
+	p := DefaultCancelPolicy()
+
+	q, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range q {
+		v := q.Get(k)
+
+		switch k {
+		case "parity":
+			switch v {
+			case "odd":
+				p.Parity = models.ParityOdd
+			case "even":
+				p.Parity = models.ParityEven
+			case "any":
+				p.Parity = models.ParityAny
+			default:
+				return nil, fmt.Errorf("parity must be odd, even or any")
+			}
+
+		case "limit":
+			p.Limit, err = strconv.Atoi(v)
+			if err != nil || p.Limit < 1 {
+				return nil, fmt.Errorf("limit must be positive number")
+			}
+
+		case "user":
+			p.UserId = v
+
+		case "source":
+			// name or id of source type
+			t, ok := sources.Find(v)
+			if id, err := strconv.Atoi(v); !ok && err == nil {
+				t, ok = sources.Get(id)
+			}
+
+			if !ok {
+				return nil, fmt.Errorf("source %s: not acceptable source type", v)
+			}
+			p.Source = &t.ID
+
+		case "min_age", "max_age":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("%s: wrong duration", k)
+			}
+
+			if k == "min_age" {
+				p.MinAge = d
+			} else {
+				p.MaxAge = d
+			}
+
+		case "min_amount", "max_amount":
+			a, err := models.ParseMoney(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", k, err)
+			}
+
+			if k == "min_amount" {
+				p.MinAmount = &a
+			} else {
+				p.MaxAmount = &a
+			}
+
+		default:
+			return nil, fmt.Errorf("unknown cancel policy parameter %s", k)
+		}
+	}
+
+	return p, nil
+}
+
+// cron expression ("*/5 * * * *", "@hourly", "@every 10m")
+func ParseSchedule(s string) (Schedule, error) {
+	return cron.ParseStandard(s)
+}
@@ -7,7 +7,7 @@ import (
 
 func (h *Server) CreateData(data *models.Data) error {
 
-	if err := h.Repo.Db.Create(data).Error; err != nil {
+	if err := h.Repo.CreateData(data); err != nil {
 		log.Println(err)
 		return err
 	}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/labstack/echo"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// balance saved to dead letters instead of retrying forever. cache balance kept, not saved again
+func (h *Server) deadLetter(b models.UserBalance, cause error) error {
+	return h.saveDeadLetter(models.DeadLetterBalance, b.UserId, b, cause)
+}
+
+// buffered transaction saved to dead letters instead of retrying forever. removed from insert queue
+// balance change already in cache balance. posted as adjustment with dead letter, saved balance stays equal to ledger
+func (h *Server) deadLetterTransaction(d models.Data, cause error) error {
+	var entries []models.JournalEntry
+	if d.Status == models.StatusProcessed {
+		entries = append(entries, models.AdjustmentEntry(d.UserId, d.Delta()))
+	}
+
+	return h.saveDeadLetter(models.DeadLetterTransaction, d.TransactionId, d, cause, entries...)
+}
+
+func (h *Server) saveDeadLetter(kind, key string, row interface{}, cause error, entries ...models.JournalEntry) error {
+
+	payload, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	letter := models.DeadLetter{Kind: kind, Key: strconv.QuoteToASCII(key), Payload: string(payload), Error: cause.Error()}
+	if err := h.Repo.SaveDeadLetter(&letter, entries...); err != nil {
+		return err
+	}
+
+	log.Printf("%s %s can't be saved: %v. saved to dead letters", kind, letter.Key, cause)
+	return nil
+}
+
+// @Summary Dead letters
+// @Security BearerAuth
+// @Tags dead letters
+// @Description rows which can never be written to database. latest first
+// @Produce json
+// @Success 200 {object} models.Response
+// @Failure 401,403 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/dead-letters [get]
+func (h *Server) FetchDeadLetters(c echo.Context) error {
+
+	letters, err := h.Repo.FetchDeadLetters()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "dead letters", Data: letters})
+}
@@ -1,21 +1,45 @@
 package handlers
 
 import (
-	"fmt"
+	"errors"
 	"github.com/SaCavid/simple-task/models"
 	"github.com/SaCavid/simple-task/service"
 	"github.com/labstack/echo"
 	"net/http"
-	"strconv"
 	"sync"
 	"time"
 )
 
+// response header of replayed response for already processed transaction id
+const HeaderReplay = "Idempotent-Replay"
+
+// IdPolicy decides which requests use transaction id. used transaction id can't be used with another request
+// policy applied same way to Server.TransactionIds, saved transaction records and after restart
+type IdPolicy int
+
+const (
+	// every request with not empty transaction id uses it. even with unknown source type or invalid data.
+	// error transaction record saved for every request
+	BurnAny IdPolicy = iota
+
+	// only requests with known source type and valid state, amount and transaction id use it.
+	// invalid requests not saved. transaction id can be sent again with corrected request
+	BurnValidated
+)
+
 type Server struct {
 	Mu sync.Mutex
 
+	// true --> durable mode. balance and transaction record committed to database before response
+	// false --> buffered mode. saved in memory and periodically bulk inserted. faster but not crash safe
+	Durable bool
+
+	// which requests use transaction id. default BurnAny
+	IdPolicy IdPolicy
+
 	// For faster Transaction id check - must be unique id -- Better to use Redis
-	TransactionIds map[string]string
+	// saved response of every transaction id for idempotent replay
+	TransactionIds map[string]models.Outcome
 
 	// if true --> there is not saved balance in UserBalances
 	Balance bool
@@ -23,136 +47,269 @@ type Server struct {
 	// For faster user balance check -- Better to use Redis
 	UserBalances map[string]models.Balance
 
-	// temp map for transaction records.
-	// periodically emptied
-	Transactions []models.Data
+	// buffered transaction records waiting for bulk insert. zero value ready
+	Transactions TransactionQueue
+
+	// buffered transactions inserted when batch is full or delay passed. 0 --> InsertBatch / InsertDelay
+	InsertBatch int
+	InsertDelay time.Duration
+
+	// providers by api key hash. for faster api key check
+	// changed with provider management api of this instance
+	Providers map[string]models.Provider
+
+	// bearer token verifier. nil --> only api keys of providers accepted
+	Jwt *service.JWTVerifier
 
-	// Database transactions
-	Repo *service.TaskRepository
+	// allowed age of signed request. 0 --> SignatureWindow
+	SignatureWindow time.Duration
+
+	// registry of source types. request source type checked with it
+	SourceTypes *SourceTypes
+
+	// records canceled by post processing and when. nil --> 10 latest odd records every N_MINUTES
+	CancelPolicy   CancelPolicy
+	CancelSchedule Schedule
+
+	// how often leader election lock taken and checked. 0 --> LeaderInterval
+	LeaderInterval time.Duration
+
+	// reconciliation job. balances compared with balance recomputed from transaction records
+	// repair --> database and cache balance corrected. reports saved to ReconcileDir if not empty
+	ReconcileInterval time.Duration
+	ReconcileRepair   bool
+	ReconcileDir      string
+
+	// Database transactions. postgres or in-memory storage
+	Repo service.Repository
+
+	// write-ahead log for buffered mode. nil --> disabled
+	// every accepted transaction fsynced before response and replayed on startup
+	Wal *service.WAL
+
+	walBalanceSeq uint64 // balances of wal records up to this seq saved to database
+	walCompacted  uint64 // wal records up to this seq removed
+
+	cancelPending  map[uint]pendingCancel // accepted cancels not saved to database yet. by record id
+	canceled       map[uint]bool          // cancels saved by this instance. record read before save can be canceled again
+	flushMu        sync.Mutex             // one bulk insert of buffered transactions at same time
+	leading        bool                   // singleton jobs run by this instance
+	full           chan struct{}          // batch of buffered transactions full
+	inserted       uint64                 // buffered transactions inserted since start
+	insertFailures uint64                 // failed bulk inserts since start
+	deadLettered   uint64                 // buffered transactions saved to dead letters since start
 }
 
 // @Summary Processing
-// @Security ApiKeyAuth
+// @Security ProviderKeyAuth
+// @Security BearerAuth
 // @Tags handler
 // @Description process posted requests
 // @ID create account
 // @Accept json
 // @Produce json
 // @Param input body models.JsonData true "transaction info"
-// @Success 200 {integer} integer 1
-// @Failure 400,404 {object} models.Response
+// @Success 201 {object} models.Response
+// @Failure 400,401,403,406,409 {object} models.Response
 // @Failure 500 {object} models.Response
 // @Failure default {object} models.Response
 // @Router /api/processing [post]
 func (h *Server) Handler(c echo.Context) error {
 
 	jd := new(models.JsonData)
-	var balance float64
 
 	// Bad request check - JSON object must be used as post body
 	// Example json from task used as model :
-	// {"state": "win", "amount": "10.15", "transactionId": "some generated identification"}
+	// {"userId": "registered id", "state": "win", "amount": "10.15", "transactionId": "some generated identification"}
 	if err := c.Bind(&jd); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "bad request"})
 	}
 
-	// check if this transaction id already used
-	if h.CheckTransactionId(jd.TransactionId) {
-		return echo.NewHTTPError(http.StatusNotAcceptable, &models.Response{
-			Error:   true,
-			Message: fmt.Sprintf("this transaction id already used")})
-	}
-
-	// Save transaction id not to use again ever if its failed
-	h.SaveTransactionId(jd.TransactionId)
-
 	// source type for request
 	// can be added new source types in stated.go file
-	var s SourceType
 	jd.Source = c.Request().Header.Get("Source-Type")
-	i, err := s.IndexOf(jd.Source)
-	if err != nil {
-		// not existing source type or not registered source type
-		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: err.Error()})
+
+	// provider authenticated with api key in ProviderAuth middleware
+	// user id sent in request body. for registration must be used  /api/register url
+	provider, ok := c.Get(ContextProvider).(models.Provider)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, &models.Response{Error: true, Message: "provider not authenticated"})
 	}
+	id := jd.UserId
 
-	// simple authorization for task
-	// all requests must include authorization header with registered id
-	// for registration must be used  /api/register url
-	id := c.Request().Header.Get("Authorization")
+	// record with invalid transaction id can never be saved
+	if !models.ValidId(jd.TransactionId) {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "transaction id must be utf-8 without null character"})
+	}
 
-	if err := jd.ValidateData(); err != nil {
-		// create clean data to save transaction information
-		data := models.Data{
-			UserId:        id,
-			State:         false,
-			Source:        i,
-			Status:        2, // error . saved for unique transaction id.
-			Amount:        0,
-			TransactionId: jd.TransactionId,
+	// validated policy. invalid request doesnt use transaction id. can be sent again with correct request
+	if h.IdPolicy == BurnValidated {
+		if _, _, err := h.validate(jd); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: err.Error()})
 		}
-		data.CreatedAt = time.Now()
-		data.UpdatedAt = time.Now()
+	}
 
-		h.SaveTransaction(data)
-		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: err.Error()})
+	// check if this transaction id already used
+	// same request with same transaction id gets saved response. different request gets conflict error
+	hash := jd.RequestHash(id)
+	if jd.TransactionId != "" {
+		if o, used := h.ReserveTransactionId(jd.TransactionId, hash); used {
+			return replay(c, o, hash)
+		}
 	}
 
-	a, err := strconv.ParseFloat(jd.Amount, 64)
+	code, res := h.process(id, provider.ID, jd, hash)
+
+	// saved for idempotent replay. transaction id not allowed to use again ever if its failed
+	if jd.TransactionId != "" {
+		h.SaveOutcome(jd.TransactionId, models.Outcome{RequestHash: hash, Code: code, Response: *res})
+	}
+
+	return respond(c, code, res)
+}
+
+// validate request. returns source type and amount
+func (h *Server) validate(jd *models.JsonData) (models.SourceType, models.Money, error) {
+
+	t, err := h.SourceTypes.Accept(jd.Source)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+		// not existing source type, not registered or disabled source type
+		return t, 0, err
+	}
+
+	if err := jd.ValidateData(); err != nil {
+		return t, 0, err
 	}
 
+	// exact amount. rejects negative, NaN/Inf, exponent notation and more than 2 decimals
+	a, err := models.ParseMoney(jd.Amount)
+	if err != nil {
+		return t, 0, err
+	}
+
+	// allowed states and amount limits of source type
+	if err := t.Rules.Check(jd.State, a); err != nil {
+		return t, 0, err
+	}
+
+	return t, a, nil
+}
+
+// process request. returns response status code and response
+// every response except empty transaction id saved as transaction record
+func (h *Server) process(id string, providerId uint, jd *models.JsonData, hash string) (int, *models.Response) {
+
 	data := models.Data{
 		UserId:        id,
-		State:         false,
-		Source:        i,
-		Status:        2, // error . saved for unique transaction id. not to allow repeat
-		Amount:        a,
+		State:         jd.State == "win",
+		Source:        -1, // unknown source
+		Status:        2,  // error . saved for unique transaction id. not to allow repeat
+		Amount:        0,
 		TransactionId: jd.TransactionId,
+		ProviderId:    providerId,
+		RequestHash:   hash,
 	}
 	data.CreatedAt = time.Now()
 	data.UpdatedAt = time.Now()
 
-	// simple authentication. not logged if empty
+	// error record with response. saved for unique transaction id and replay
+	// empty transaction id can't be saved. transaction id must be unique in database
+	fail := func(code int, message string) (int, *models.Response) {
+		data.Status = 2
+		data.Balance = 0
+		data.Code = code
+		data.Message = message
+		if data.TransactionId != "" {
+			h.SaveTransaction(data)
+		}
+		return code, &models.Response{Error: true, Message: message}
+	}
+
+	// write-ahead log failed. error record cant be written too
+	walFailed := func() (int, *models.Response) {
+		return http.StatusServiceUnavailable, &models.Response{Error: true, Message: "transaction log unavailable"}
+	}
+
+	t, a, err := h.validate(jd)
+	data.Source = t.ID
+	if err != nil {
+		return fail(http.StatusBadRequest, err.Error())
+	}
+	data.Amount = a
+	data.AllowNegative = t.Rules.AllowNegative
+
 	if id == "" {
-		h.SaveTransaction(data)
-		return echo.NewHTTPError(http.StatusForbidden, &models.Response{Error: true, Message: "not logged"})
+		return fail(http.StatusBadRequest, "user id cant be null")
 	}
 
 	// fast check registered user
 	if !h.CheckUser(id) {
-		h.SaveTransaction(data)
-		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "user didnt registered"})
+		return fail(http.StatusBadRequest, "user didnt registered")
 	}
 
+	data.Code = http.StatusCreated
+	data.Message = "transaction processed"
+
+	var balance models.Money
+
 	// switch depended on state of request
 	switch jd.State {
 	case "win":
 
 		balance, err = h.UserWin(id, &data)
+		if errors.Is(err, service.ErrWALFailed) {
+			return walFailed()
+		}
 		if err != nil {
-			data.Status = 2
-			h.SaveTransaction(data)
-			return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+			return fail(http.StatusInternalServerError, err.Error())
 		}
 
-		break
 	case "lose":
 
 		balance, err = h.UserLost(id, &data)
+		if errors.Is(err, service.ErrWALFailed) {
+			return walFailed()
+		}
 		if err != nil {
-			data.Status = 2
-			h.SaveTransaction(data)
-			return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: err.Error() + " " + jd.State + "-->" + jd.Amount + " Balance:" + fmt.Sprintf("%.2f", balance)})
+			return fail(http.StatusBadRequest, err.Error()+" "+jd.State+"-->"+jd.Amount+" Balance:"+balance.String())
 		}
 
-		break
 	default:
 
-		h.SaveTransaction(data)
-		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "error with state"})
+		return fail(http.StatusBadRequest, "error with state")
+	}
+
+	return http.StatusCreated, &models.Response{Message: data.Message, Data: "Balance:" + balance.String()}
+}
+
+// error responses returned as echo errors same as before
+func respond(c echo.Context, code int, res *models.Response) error {
+	if code >= http.StatusBadRequest {
+		return echo.NewHTTPError(code, res)
+	}
+
+	return c.JSON(code, res)
+}
+
+// response for already used transaction id
+func replay(c echo.Context, o models.Outcome, hash string) error {
+
+	// saved before request hashes. can't be compared
+	if o.RequestHash == "" {
+		return echo.NewHTTPError(http.StatusNotAcceptable, &models.Response{Error: true, Message: "this transaction id already used"})
 	}
 
-	return c.JSON(201, &models.Response{Message: "transaction processed", Data: "Balance:" + fmt.Sprintf("%.2f", balance)})
+	if o.RequestHash != hash {
+		return echo.NewHTTPError(http.StatusConflict, &models.Response{Error: true, Message: "this transaction id already used with different request"})
+	}
+
+	// first request with this transaction id not finished yet
+	if o.Code == 0 {
+		return echo.NewHTTPError(http.StatusConflict, &models.Response{Error: true, Message: "transaction with this id is still processing"})
+	}
+
+	c.Response().Header().Set(HeaderReplay, "true")
+
+	res := o.Response
+	return respond(c, o.Code, &res)
 }
@@ -3,7 +3,8 @@ package handlers
 import (
 	"encoding/json"
 	"github.com/SaCavid/simple-task/models"
-	"github.com/labstack/echo/v4"
+	"github.com/SaCavid/simple-task/service"
+	"github.com/labstack/echo"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -14,17 +15,20 @@ import (
 var (
 	msg1                   = `{"state": "win", "amount": "10.15", "transactionId": "Same identification 1"}`
 	msg2                   = `{"state": "win", "amount": "10.15", "transactionId": "Same identification 2"}`
-	msg3                   = `{"state": "win", "amount": "10.15", "transactionId": "Same identification 3"}`
+	msg3                   = `{"userId": "not-registered-id", "state": "win", "amount": "10.15", "transactionId": "Same identification 3"}`
 	errorUsedTransactionId = `{"state": "win", "amount": "10.15", "transactionId": "Same identification 1"}`
 	errorNoTransactionId   = `{"state": "win", "amount": "10.15", "transactionId": ""}`
 	errorNoState           = `{"state": "", "amount": "10.15", "transactionId": "Some identification"}`
 	errorState             = `{"state": "error-state", "amount": "10.15", "transactionId": "Some identification 4"}`
 	errorNullAmount        = `{"state": "win", "amount": "", "transactionId": "Some identification 5"}`
-	winMsg                 = `{"state": "win", "amount": "27.99", "transactionId": "Some identification 10"}`
-	loseMsg                = `{"state": "lose", "amount": "12.33", "transactionId": "Some identification 11"}`
-	negativeMsg            = `{"state": "lose", "amount": "107.99", "transactionId": "Some identification 12"}`
+	winMsg                 = `{"userId": "registered-id", "state": "win", "amount": "27.99", "transactionId": "Some identification 10"}`
+	loseMsg                = `{"userId": "registered-id", "state": "lose", "amount": "12.33", "transactionId": "Some identification 11"}`
+	negativeMsg            = `{"userId": "registered-id", "state": "lose", "amount": "107.99", "transactionId": "Some identification 12"}`
 )
 
+// provider authenticated by ProviderAuth middleware
+var testProvider = models.Provider{Name: "test", SourceTypes: "game,server,payment"}
+
 type msg struct {
 	state         string
 	amount        float64
@@ -33,8 +37,10 @@ type msg struct {
 
 func TestServer_Handler(t *testing.T) {
 	h := &Server{
-		TransactionIds: make(map[string]string, 0),
+		TransactionIds: make(map[string]models.Outcome, 0),
 		UserBalances:   make(map[string]models.Balance, 0),
+		SourceTypes:    NewSourceTypes(models.DefaultSourceTypes),
+		Repo:           service.NewMemoryRepository(),
 	}
 
 	e := echo.New()
@@ -47,7 +53,7 @@ func TestServer_Handler(t *testing.T) {
 	h.noTransactionId(e)
 	h.noAmount(e)
 	h.sameTransactionId(e)
-	h.notLogged(e)
+	h.noUserId(e)
 
 	h.notRegistered(e)
 	h.userWin(e)
@@ -62,6 +68,7 @@ func (h *Server) badRequest(e *echo.Echo) {
 	req.Header.Set("Source-type", "not-source")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	err := h.Handler(c)
 	if err != nil {
@@ -77,6 +84,7 @@ func (h *Server) notAcceptableSourceType(e *echo.Echo) {
 	req.Header.Set("Source-type", "not-source")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	err := h.Handler(c)
 	if err != nil {
@@ -92,6 +100,7 @@ func (h *Server) noState(e *echo.Echo) {
 	req.Header.Set("Source-type", "server")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	err := h.Handler(c)
 	if err != nil {
@@ -107,6 +116,7 @@ func (h *Server) wrongState(e *echo.Echo) {
 	req.Header.Set("Source-type", "server")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	err := h.Handler(c)
 	if err != nil {
@@ -122,6 +132,7 @@ func (h *Server) noTransactionId(e *echo.Echo) {
 	req.Header.Set("Source-type", "server")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	err := h.Handler(c)
 	if err != nil {
@@ -137,6 +148,7 @@ func (h *Server) noAmount(e *echo.Echo) {
 	req.Header.Set("Source-type", "server")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	err := h.Handler(c)
 	if err != nil {
@@ -152,24 +164,26 @@ func (h *Server) sameTransactionId(e *echo.Echo) {
 	req.Header.Set("Source-type", "server")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	err := h.Handler(c)
 	if err != nil {
-		log.Println("Testing repeat transaction id. Expected Code: 406. Got:", err.Error())
+		log.Println("Testing repeat transaction id with different request. Expected Code: 409. Got:", err.Error())
 	}
 }
 
-func (h *Server) notLogged(e *echo.Echo) {
+func (h *Server) noUserId(e *echo.Echo) {
 	// Setup
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(msg2))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	req.Header.Set("Source-type", "server")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	err := h.Handler(c)
 	if err != nil {
-		log.Println("Testing not logged. Expected Code: 403. Got:", err.Error())
+		log.Println("Testing null user id. Expected Code: 400. Got:", err.Error())
 	}
 }
 
@@ -178,9 +192,9 @@ func (h *Server) notRegistered(e *echo.Echo) {
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(msg3))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	req.Header.Set("Source-type", "server")
-	req.Header.Set("Authorization", "not-registered-id")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	err := h.Handler(c)
 	if err != nil {
@@ -193,9 +207,9 @@ func (h *Server) userWin(e *echo.Echo) {
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(winMsg))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	req.Header.Set("Source-type", "server")
-	req.Header.Set("Authorization", "registered-id")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	b := models.Balance{
 		Amount: 0,
@@ -215,9 +229,9 @@ func (h *Server) userLose(e *echo.Echo) {
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(loseMsg))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	req.Header.Set("Source-type", "server")
-	req.Header.Set("Authorization", "registered-id")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	err := h.Handler(c)
 	if err == nil {
@@ -230,9 +244,9 @@ func (h *Server) errorNegativeBalance(e *echo.Echo) {
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(negativeMsg))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	req.Header.Set("Source-type", "server")
-	req.Header.Set("Authorization", "registered-id")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	err := h.Handler(c)
 	if err != nil {
@@ -245,9 +259,9 @@ func (h *Server) benchmarkRegistered(e *echo.Echo, msg string) {
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(msg))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	req.Header.Set("Source-type", "server")
-	req.Header.Set("Authorization", "registered-id")
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
+	c.Set(ContextProvider, testProvider)
 
 	b := models.Balance{
 		Amount: 0,
@@ -263,8 +277,10 @@ func (h *Server) benchmarkRegistered(e *echo.Echo, msg string) {
 func BenchmarkServer_Handler(b *testing.B) {
 
 	h := &Server{
-		TransactionIds: make(map[string]string, 0),
+		TransactionIds: make(map[string]models.Outcome, 0),
 		UserBalances:   make(map[string]models.Balance, 0),
+		SourceTypes:    NewSourceTypes(models.DefaultSourceTypes),
+		Repo:           service.NewMemoryRepository(),
 	}
 
 	e := echo.New()
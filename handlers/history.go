@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/labstack/echo"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	historyLimit    = 50  // default page size
+	historyMaxLimit = 500 // maximum page size
+)
+
+// @Summary User transactions
+// @Security BearerAuth
+// @Tags users
+// @Description transaction history of user. latest first. keyset pagination with nextCursor
+// @Produce json
+// @Param id path string true "user id"
+// @Param state query string false "win / lose"
+// @Param status query string false "processed / error / canceled / cancel denied"
+// @Param source query string false "source type"
+// @Param min_amount query string false "minimum amount"
+// @Param max_amount query string false "maximum amount"
+// @Param from query string false "created at or after. RFC3339"
+// @Param to query string false "created before. RFC3339"
+// @Param cursor query integer false "nextCursor of previous page"
+// @Param limit query integer false "page size. default 50, maximum 500"
+// @Success 200 {object} models.Response
+// @Failure 400,401,403 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/users/{id}/transactions [get]
+func (h *Server) UserTransactions(c echo.Context) error {
+
+	f, err := h.historyFilter(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	// one more record to know if next page exists
+	limit := f.Limit
+	f.Limit++
+
+	data, err := h.Repo.UserTransactions(f)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	page := models.TransactionPage{Transactions: make([]models.TransactionInfo, 0, limit)}
+	if len(data) > limit {
+		data = data[:limit]
+		page.NextCursor = data[limit-1].ID
+	}
+
+	for _, v := range data {
+		page.Transactions = append(page.Transactions, h.transactionInfo(v, false))
+	}
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "transactions", Data: page})
+}
+
+// parse query parameters of history request
+func (h *Server) historyFilter(c echo.Context) (models.TransactionFilter, error) {
+
+	f := models.TransactionFilter{UserId: c.Param("id"), Limit: historyLimit}
+
+	if v := c.QueryParam("state"); v != "" {
+		if v != "win" && v != "lose" {
+			return f, fmt.Errorf("wrong state")
+		}
+		win := v == "win"
+		f.State = &win
+	}
+
+	if v := c.QueryParam("status"); v != "" {
+		status, err := models.ParseStatus(v)
+		if err != nil {
+			return f, err
+		}
+		f.Status = status
+	}
+
+	if v := c.QueryParam("source"); v != "" {
+		// disabled source types included. old transactions can be filtered
+		t, ok := h.SourceTypes.Find(v)
+		if !ok {
+			return f, fmt.Errorf("not acceptable source type")
+		}
+		f.Source = &t.ID
+	}
+
+	if v := c.QueryParam("min_amount"); v != "" {
+		a, err := models.ParseMoney(v)
+		if err != nil {
+			return f, fmt.Errorf("min_amount: %v", err)
+		}
+		f.MinAmount = &a
+	}
+
+	if v := c.QueryParam("max_amount"); v != "" {
+		a, err := models.ParseMoney(v)
+		if err != nil {
+			return f, fmt.Errorf("max_amount: %v", err)
+		}
+		f.MaxAmount = &a
+	}
+
+	if v := c.QueryParam("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("from: time must be in RFC3339 format")
+		}
+		f.From = t
+	}
+
+	if v := c.QueryParam("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("to: time must be in RFC3339 format")
+		}
+		f.To = t
+	}
+
+	if v := c.QueryParam("cursor"); v != "" {
+		cursor, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("wrong cursor")
+		}
+		f.Cursor = uint(cursor)
+	}
+
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > historyMaxLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", historyMaxLimit)
+		}
+		f.Limit = limit
+	}
+
+	return f, nil
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"github.com/SaCavid/simple-task/service"
+	"log"
+	"sync"
+	"time"
+)
+
+// how often follower tries to take lock and leader checks it
+const LeaderInterval = 5 * time.Second
+
+// run singleton jobs only while this instance holds lock
+// jobs stopped when lock lost and started again on instance which takes lock next
+// stops when ctx canceled. lock released after jobs stopped
+func (h *Server) Leader(ctx context.Context, lock service.Lock, jobs ...func(ctx context.Context)) {
+
+	interval := h.LeaderInterval
+	if interval <= 0 {
+		interval = LeaderInterval
+	}
+
+	for {
+		ok, err := lock.TryAcquire(ctx)
+		if err != nil {
+			log.Println("Leader election:", err)
+		}
+
+		if ok {
+			log.Println("Leader elected. singleton jobs started")
+			h.lead(ctx, lock, interval, jobs)
+			log.Println("Singleton jobs stopped")
+		}
+
+		if !sleep(ctx, interval) {
+			return
+		}
+	}
+}
+
+// run jobs until ctx canceled or lock lost
+func (h *Server) lead(ctx context.Context, lock service.Lock, interval time.Duration, jobs []func(ctx context.Context)) {
+
+	h.Mu.Lock()
+	h.leading = true
+	h.Mu.Unlock()
+
+	jobCtx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job func(ctx context.Context)) {
+			defer wg.Done()
+			job(jobCtx)
+		}(job)
+	}
+
+	for sleep(ctx, interval) {
+		if err := lock.Held(ctx); err != nil {
+			log.Println("Leadership lost:", err)
+			break
+		}
+	}
+
+	// other instance can take lock before jobs stopped after lost connection
+	// cancels are saved only once anyway
+	cancel()
+	wg.Wait()
+
+	if err := lock.Release(); err != nil {
+		log.Println(err)
+	}
+
+	h.Mu.Lock()
+	h.leading = false
+	h.Mu.Unlock()
+}
+
+// true while this instance runs singleton jobs
+func (h *Server) Leading() bool {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	return h.leading
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"github.com/SaCavid/simple-task/models"
+	"github.com/labstack/echo"
+	"net/http"
+)
+
+// @Summary User ledger
+// @Security BearerAuth
+// @Tags users
+// @Description postings of user account with balance after every posting. shows how balance reached
+// @Produce json
+// @Param id path string true "user id"
+// @Success 200 {object} models.Response
+// @Failure 401,403 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/users/{id}/ledger [get]
+func (h *Server) UserLedger(c echo.Context) error {
+
+	lines, err := h.Repo.UserLedger(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "ledger", Data: lines})
+}
+
+// @Summary Check ledger
+// @Security BearerAuth
+// @Tags ledger
+// @Description users with balance different from sum of postings and not balanced journal entries
+// @Produce json
+// @Success 200 {object} models.Response
+// @Failure 401,403 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/ledger/check [get]
+func (h *Server) CheckLedger(c echo.Context) error {
+
+	report, err := h.Repo.CheckLedger()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	h.Mu.Lock()
+	report.Pending = h.Transactions.Len() + len(h.cancelPending)
+	for _, v := range h.UserBalances {
+		if v.Saved {
+			report.Pending++
+		}
+	}
+	h.Mu.Unlock()
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "ledger check", Data: report})
+}
@@ -0,0 +1,2578 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/SaCavid/simple-task/service"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	// api key of provider allowed to send all source types
+	testApiKey = "pk_test"
+
+	// secret of HS256 test tokens
+	testJwtSecret = "test-secret"
+)
+
+func newTestServer(repo service.Repository) *Server {
+	h := &Server{
+		TransactionIds: make(map[string]models.Outcome, 0),
+		UserBalances:   make(map[string]models.Balance, 0),
+		SourceTypes:    NewSourceTypes(models.DefaultSourceTypes),
+		Repo:           repo,
+	}
+
+	h.Jwt, _ = service.NewJWTVerifier(testJwtSecret, "")
+	h.setProvider("", models.Provider{Name: "test", KeyHash: models.HashApiKey(testApiKey), SourceTypes: "game,server,payment"})
+	return h
+}
+
+// HS256 bearer token valid for one hour
+func testToken(role, subject string) string {
+	claims := service.Claims{Role: role, RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   subject,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testJwtSecret))
+	return token
+}
+
+// send request to handler and return response status code
+func serve(e *echo.Echo, handler echo.HandlerFunc, req *http.Request) (int, *httptest.ResponseRecorder) {
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if err := handler(c); err != nil {
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he.Code, rec
+		}
+		return http.StatusInternalServerError, rec
+	}
+
+	return rec.Code, rec
+}
+
+func registerUser(t *testing.T, e *echo.Echo, h *Server, id string) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(`{"UserId":"`+id+`"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	if code, rec := serve(e, h.Register, req); code != http.StatusOK {
+		t.Fatalf("register %s: got %d %s", id, code, rec.Body.String())
+	}
+}
+
+func process(e *echo.Echo, h *Server, user, body string) (int, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(http.MethodPost, "/api/processing", strings.NewReader(withUser(user, body)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("Source-Type", "game")
+	req.Header.Set(HeaderApiKey, testApiKey)
+
+	return serve(e, h.ProviderAuth(h.Handler), req)
+}
+
+// add user id to json request body
+func withUser(user, body string) string {
+	return `{"userId": "` + user + `", ` + strings.TrimPrefix(body, "{")
+}
+
+func userBalance(t *testing.T, repo service.Repository, id string) models.Money {
+	t.Helper()
+
+	users, err := repo.FetchUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range users {
+		if u.UserId == id {
+			return u.Balance
+		}
+	}
+
+	t.Fatalf("user %s not found", id)
+	return 0
+}
+
+// processing, bulk insert, balance update and post processing without database
+func TestServer_Pipeline(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "pipeline-user")
+
+	// opening balance parsed strict same as amounts
+	req := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(`{"UserId": "negative-user", "Balance": "-10"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if code, _ := serve(e, h.Register, req); code != http.StatusBadRequest || h.CheckUser("negative-user") {
+		t.Fatalf("expected 400 for negative opening balance, got %d", code)
+	}
+
+	requests := []struct {
+		body string
+		code int
+	}{
+		{`{"state": "win", "amount": "100.10", "transactionId": "p-1"}`, http.StatusCreated},
+		{`{"state": "lose", "amount": "0.10", "transactionId": "p-2"}`, http.StatusCreated},
+		{`{"state": "win", "amount": "5.05", "transactionId": "p-3"}`, http.StatusCreated},
+		{`{"state": "lose", "amount": "500", "transactionId": "p-4"}`, http.StatusBadRequest},
+		{`{"state": "win", "amount": "1.005", "transactionId": "p-5"}`, http.StatusBadRequest},
+		{`{"state": "win", "amount": "1e2", "transactionId": "p-6"}`, http.StatusBadRequest},
+		{`{"state": "win", "amount": "5.05", "transactionId": "p-3"}`, http.StatusCreated}, // replay
+		{`{"state": "win", "amount": "5.06", "transactionId": "p-3"}`, http.StatusConflict},
+		{`{"state": "win", "amount": "1", "transactionId": "p-\u0000"}`, http.StatusBadRequest}, // can never be saved
+	}
+
+	for _, r := range requests {
+		if code, rec := process(e, h, "pipeline-user", r.body); code != r.code {
+			t.Fatalf("%s: expected %d got %d %s", r.body, r.code, code, rec.Body.String())
+		}
+	}
+
+	n, err := h.flushTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 6 {
+		t.Fatalf("expected 6 inserted transactions, got %d", n)
+	}
+
+	if err := h.flushBalances(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := userBalance(t, repo, "pipeline-user"); b != 10505 {
+		t.Fatalf("expected balance 105.05, got %s", b)
+	}
+
+	// odd ids: 5 (error record) skipped, 3 (win 5.05) canceled,
+	// 1 (win 100.10) denied because balance can't be negative
+	if err := h.cancelTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.flushBalances(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := userBalance(t, repo, "pipeline-user"); b != 10000 {
+		t.Fatalf("expected balance 100.00, got %s", b)
+	}
+
+	// cancelled records must not be processed twice
+	if err := h.cancelTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Mu.Lock()
+	b := h.UserBalances["pipeline-user"].Amount
+	h.Mu.Unlock()
+
+	if b != 10000 {
+		t.Fatalf("expected cached balance 100.00, got %s", b)
+	}
+
+	// new server instance must restore state from repository
+	restarted := newTestServer(repo)
+	if err := restarted.FetchData(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !restarted.CheckTransactionId("p-1") || !restarted.CheckUser("pipeline-user") {
+		t.Fatalf("state not restored from repository")
+	}
+
+	if code, _ := process(e, restarted, "pipeline-user", `{"state": "win", "amount": "1", "transactionId": "p-1"}`); code != http.StatusConflict {
+		t.Fatalf("expected used transaction id after restart, got %d", code)
+	}
+}
+
+// durable mode must save balance and transaction record before response. no background workers needed
+func TestServer_Durable(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	h.Durable = true
+	e := echo.New()
+
+	registerUser(t, e, h, "durable-user")
+
+	if code, rec := process(e, h, "durable-user", `{"state": "win", "amount": "20.50", "transactionId": "d-1"}`); code != http.StatusCreated {
+		t.Fatalf("win: expected 201 got %d %s", code, rec.Body.String())
+	}
+
+	if code, _ := process(e, h, "durable-user", `{"state": "lose", "amount": "30", "transactionId": "d-2"}`); code != http.StatusBadRequest {
+		t.Fatalf("lose: expected 400 got %d", code)
+	}
+
+	if code, _ := process(e, h, "durable-user", `{"state": "lose", "amount": "0.50", "transactionId": "d-3"}`); code != http.StatusCreated {
+		t.Fatalf("lose: expected 201 got %d", code)
+	}
+
+	buffered := h.Transactions.Len()
+
+	if buffered != 0 {
+		t.Fatalf("expected empty buffer in durable mode, got %d", buffered)
+	}
+
+	if b := userBalance(t, repo, "durable-user"); b != 2000 {
+		t.Fatalf("expected balance 20.00, got %s", b)
+	}
+
+	data, err := repo.FetchTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) != 3 || data[0].Status != 1 || data[1].Status != 2 || data[2].Status != 1 {
+		t.Fatalf("unexpected transaction records %+v", data)
+	}
+
+	// id 3 (lose 0.50) canceled --> 20.50, then id 1 (win 20.50) canceled --> 0.00
+	if err := h.cancelTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := userBalance(t, repo, "durable-user"); b != 0 {
+		t.Fatalf("expected balance 0.00 after cancel, got %s", b)
+	}
+
+	// canceled records must not be processed twice
+	c := models.NewCancellation(data[2], models.ReasonPostProcessing, "")
+	if _, err := repo.ApplyCancel(&data[2], &c); err != service.ErrAlreadyCanceled {
+		t.Fatalf("expected already canceled error, got %v", err)
+	}
+}
+
+// buffered transactions accepted before crash must be restored from write-ahead log
+func TestServer_WALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transactions.wal")
+
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	wal, err := service.OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Wal = wal
+
+	registerUser(t, e, h, "wal-user")
+
+	for _, body := range []string{
+		`{"state": "win", "amount": "50", "transactionId": "w-1"}`,
+		`{"state": "lose", "amount": "20.25", "transactionId": "w-2"}`,
+	} {
+		if code, rec := process(e, h, "wal-user", body); code != http.StatusCreated {
+			t.Fatalf("expected 201 got %d %s", code, rec.Body.String())
+		}
+	}
+
+	// first transaction and balance saved. then crash
+	h.InsertBatch = 1
+	if _, err := h.flushTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.flushBalances(); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := process(e, h, "wal-user", `{"state": "win", "amount": "0.25", "transactionId": "w-3"}`); code != http.StatusCreated {
+		t.Fatalf("expected 201 got %d", code)
+	}
+	wal.Close()
+
+	// restart
+	wal, err = service.OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	restarted := newTestServer(repo)
+	restarted.Wal = wal
+	if err := restarted.FetchData(); err != nil {
+		t.Fatal(err)
+	}
+
+	if buffered := queued(&restarted.Transactions); len(buffered) != 2 || buffered[0].TransactionId != "w-2" {
+		t.Fatalf("expected w-2 and w-3 in buffer, got %+v", buffered)
+	}
+
+	if b := restarted.UserBalances["wal-user"]; b.Amount != 3000 || !b.Saved {
+		t.Fatalf("expected not saved balance 30.00, got %+v", b)
+	}
+
+	if _, err := restarted.flushTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restarted.flushBalances(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := userBalance(t, repo, "wal-user"); b != 3000 {
+		t.Fatalf("expected balance 30.00, got %s", b)
+	}
+
+	// everything saved. log must be empty after compaction
+	restarted.compactWAL()
+
+	records, err := wal.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 0 {
+		t.Fatalf("expected empty log after compaction, got %d records", len(records))
+	}
+}
+
+// failed write-ahead log fails request with 503. process keeps running for graceful shutdown
+func TestServer_WALFailed(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	wal, err := service.OpenWAL(filepath.Join(t.TempDir(), "transactions.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Wal = wal
+
+	registerUser(t, e, h, "wal-user")
+
+	if code, _ := process(e, h, "wal-user", `{"state": "win", "amount": "5", "transactionId": "f-1"}`); code != http.StatusCreated {
+		t.Fatalf("expected 201 got %d", code)
+	}
+
+	// file closed under log. every write fails
+	wal.Close()
+
+	if code, rec := process(e, h, "wal-user", `{"state": "win", "amount": "5", "transactionId": "f-2"}`); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 got %d %s", code, rec.Body.String())
+	}
+
+	if b := h.UserBalances["wal-user"]; b.Amount != 500 {
+		t.Fatalf("balance changed without log record %+v", b)
+	}
+
+	if n := h.Transactions.Len(); n != 1 {
+		t.Fatalf("expected 1 buffered transaction, got %d", n)
+	}
+}
+
+// background workers must stop on context cancel and Flush must save everything left in memory
+func TestServer_Shutdown(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "shutdown-user")
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var workers sync.WaitGroup
+	for _, run := range []func(context.Context){h.BulkInsertTransactions, h.BulkUpdateBalances, h.PostProcessing} {
+		workers.Add(1)
+		go func(run func(context.Context)) {
+			defer workers.Done()
+			run(ctx)
+		}(run)
+	}
+
+	for i := 0; i < 20; i++ {
+		body := fmt.Sprintf(`{"state": "win", "amount": "1.01", "transactionId": "s-%d"}`, i)
+		if code, _ := process(e, h, "shutdown-user", body); code != http.StatusCreated {
+			t.Fatalf("expected 201 got %d", code)
+		}
+	}
+
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background workers didnt stop")
+	}
+
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := repo.FetchTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) != 20 {
+		t.Fatalf("expected 20 saved transactions, got %d", len(data))
+	}
+
+	if b := userBalance(t, repo, "shutdown-user"); b != 2020 {
+		t.Fatalf("expected balance 20.20, got %s", b)
+	}
+}
+
+func transactionStatus(t *testing.T, e *echo.Echo, h *Server, id string) (int, models.TransactionInfo) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/transactions/"+id, nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("transactionId")
+	c.SetParamValues(id)
+
+	if err := h.TransactionStatus(c); err != nil {
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he.Code, models.TransactionInfo{}
+		}
+		t.Fatal(err)
+	}
+
+	// balances can be negative. Money json accepts only amounts of api requests
+	var res struct {
+		Data struct {
+			models.TransactionInfo
+			Balance       signedMoney `json:"balance"`
+			Cancellations []struct {
+				models.Cancellation
+				BalanceBefore signedMoney `json:"balanceBefore"`
+				BalanceAfter  signedMoney `json:"balanceAfter"`
+			} `json:"cancellations"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	info := res.Data.TransactionInfo
+	info.Balance = models.Money(res.Data.Balance)
+	for _, v := range res.Data.Cancellations {
+		c := v.Cancellation
+		c.BalanceBefore = models.Money(v.BalanceBefore)
+		c.BalanceAfter = models.Money(v.BalanceAfter)
+		info.Cancellations = append(info.Cancellations, c)
+	}
+
+	return rec.Code, info
+}
+
+// balance in responses. can be negative
+type signedMoney models.Money
+
+func (m *signedMoney) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := models.ParseSignedMoney(s)
+	*m = signedMoney(v)
+	return err
+}
+
+// status must be same before and after bulk insert
+func TestServer_TransactionStatus(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "status-user")
+
+	process(e, h, "status-user", `{"state": "win", "amount": "12.34", "transactionId": "st-1"}`)
+	process(e, h, "status-user", `{"state": "lose", "amount": "100", "transactionId": "st-2"}`)
+
+	code, info := transactionStatus(t, e, h, "st-1")
+	if code != http.StatusOK || !info.Pending || info.Status != "processed" || info.State != "win" ||
+		info.Amount != 1234 || info.Balance != 1234 || info.Source != "game" || info.UserId != "status-user" {
+		t.Fatalf("unexpected pending status %d %+v", code, info)
+	}
+
+	if _, err := h.flushTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	code, info = transactionStatus(t, e, h, "st-1")
+	if code != http.StatusOK || info.Pending || info.Status != "processed" || info.Balance != 1234 {
+		t.Fatalf("unexpected saved status %d %+v", code, info)
+	}
+
+	code, info = transactionStatus(t, e, h, "st-2")
+	if code != http.StatusOK || info.Status != "error" || info.State != "lose" {
+		t.Fatalf("unexpected error status %d %+v", code, info)
+	}
+
+	if code, _ := transactionStatus(t, e, h, "st-unknown"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 got %d", code)
+	}
+}
+
+// same request with same transaction id gets original response. before and after restart
+func TestServer_IdempotentReplay(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "replay-user")
+
+	win := `{"state": "win", "amount": "10", "transactionId": "r-1"}`
+	lose := `{"state": "lose", "amount": "50", "transactionId": "r-2"}`
+
+	code, first := process(e, h, "replay-user", win)
+	if code != http.StatusCreated || first.Header().Get(HeaderReplay) != "" {
+		t.Fatalf("expected 201 without replay header, got %d", code)
+	}
+
+	process(e, h, "replay-user", `{"state": "win", "amount": "7", "transactionId": "r-3"}`)
+
+	code, again := process(e, h, "replay-user", win)
+	if code != http.StatusCreated || again.Header().Get(HeaderReplay) != "true" || again.Body.String() != first.Body.String() {
+		t.Fatalf("expected replayed response %s, got %d %s", first.Body.String(), code, again.Body.String())
+	}
+
+	if code, _ := process(e, h, "replay-user", lose); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 got %d", code)
+	}
+
+	// error responses replayed with same status code
+	code, rec := process(e, h, "replay-user", lose)
+	if code != http.StatusBadRequest || rec.Header().Get(HeaderReplay) != "true" {
+		t.Fatalf("expected replayed 400, got %d", code)
+	}
+
+	// same transaction id from another user is different request
+	registerUser(t, e, h, "other-user")
+	if code, _ := process(e, h, "other-user", win); code != http.StatusConflict {
+		t.Fatalf("expected 409 got %d", code)
+	}
+
+	h.Mu.Lock()
+	b := h.UserBalances["replay-user"].Amount
+	h.Mu.Unlock()
+
+	if b != 1700 {
+		t.Fatalf("replay must not change balance. expected 17.00, got %s", b)
+	}
+
+	if _, err := h.flushTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestServer(repo)
+	if err := restarted.FetchData(); err != nil {
+		t.Fatal(err)
+	}
+
+	code, rec = process(e, restarted, "replay-user", win)
+	if code != http.StatusCreated || rec.Header().Get(HeaderReplay) != "true" || rec.Body.String() != first.Body.String() {
+		t.Fatalf("expected replayed response after restart %s, got %d %s", first.Body.String(), code, rec.Body.String())
+	}
+}
+
+// transaction id policy must work same before and after restart
+func TestServer_IdPolicy(t *testing.T) {
+
+	invalid := func(e *echo.Echo, h *Server) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/processing", strings.NewReader(withUser("policy-user", `{"state": "win", "amount": "1", "transactionId": "policy-1"}`)))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Source-Type", "not-source")
+		c := e.NewContext(req, httptest.NewRecorder())
+		c.Set(ContextProvider, h.Providers[models.HashApiKey(testApiKey)])
+
+		code := http.StatusOK
+		if err := h.Handler(c); err != nil {
+			code = err.(*echo.HTTPError).Code
+		}
+		return code
+	}
+
+	valid := `{"state": "win", "amount": "1", "transactionId": "policy-1"}`
+
+	for _, c := range []struct {
+		policy IdPolicy
+		code   int // response for valid request with same transaction id
+	}{
+		{BurnAny, http.StatusConflict},
+		{BurnValidated, http.StatusCreated},
+	} {
+		for _, restart := range []bool{false, true} {
+			repo := service.NewMemoryRepository()
+			h := newTestServer(repo)
+			h.IdPolicy = c.policy
+			e := echo.New()
+
+			registerUser(t, e, h, "policy-user")
+
+			if code := invalid(e, h); code != http.StatusBadRequest {
+				t.Fatalf("policy %d: expected 400 got %d", c.policy, code)
+			}
+
+			if restart {
+				if _, err := h.flushTransactions(); err != nil {
+					t.Fatal(err)
+				}
+
+				h = newTestServer(repo)
+				h.IdPolicy = c.policy
+				if err := h.FetchData(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if code, _ := process(e, h, "policy-user", valid); code != c.code {
+				t.Fatalf("policy %d restart %v: expected %d got %d", c.policy, restart, c.code, code)
+			}
+		}
+	}
+}
+
+func history(t *testing.T, e *echo.Echo, h *Server, id, query string) (int, models.TransactionPage) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/"+id+"/transactions?"+query, nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+
+	if err := h.UserTransactions(c); err != nil {
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he.Code, models.TransactionPage{}
+		}
+		t.Fatal(err)
+	}
+
+	var res struct {
+		Data models.TransactionPage `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec.Code, res.Data
+}
+
+func TestServer_UserTransactions(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "history-user")
+	registerUser(t, e, h, "other-user")
+
+	for i := 1; i <= 7; i++ {
+		process(e, h, "history-user", fmt.Sprintf(`{"state": "win", "amount": "%d", "transactionId": "h-%d"}`, i, i))
+	}
+	process(e, h, "history-user", `{"state": "lose", "amount": "1000", "transactionId": "h-8"}`)
+	process(e, h, "other-user", `{"state": "win", "amount": "1", "transactionId": "h-9"}`)
+
+	if _, err := h.flushTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	// pages of 3. latest first
+	ids := make([]string, 0)
+	cursor := uint(0)
+	for page := 0; page < 5; page++ {
+		code, p := history(t, e, h, "history-user", fmt.Sprintf("state=win&limit=3&cursor=%d", cursor))
+		if code != http.StatusOK {
+			t.Fatalf("expected 200 got %d", code)
+		}
+
+		for _, v := range p.Transactions {
+			ids = append(ids, v.TransactionId)
+		}
+
+		if p.NextCursor == 0 {
+			break
+		}
+		cursor = p.NextCursor
+	}
+
+	if strings.Join(ids, ",") != "h-7,h-6,h-5,h-4,h-3,h-2,h-1" {
+		t.Fatalf("unexpected pages %v", ids)
+	}
+
+	_, p := history(t, e, h, "history-user", "status=error")
+	if len(p.Transactions) != 1 || p.Transactions[0].TransactionId != "h-8" {
+		t.Fatalf("unexpected error records %+v", p.Transactions)
+	}
+
+	_, p = history(t, e, h, "history-user", "min_amount=2.50&max_amount=4&source=game")
+	if len(p.Transactions) != 2 || p.Transactions[0].TransactionId != "h-4" || p.Transactions[1].TransactionId != "h-3" {
+		t.Fatalf("unexpected amount range %+v", p.Transactions)
+	}
+
+	_, p = history(t, e, h, "history-user", "to="+time.Now().Add(-time.Hour).Format(time.RFC3339))
+	if len(p.Transactions) != 0 {
+		t.Fatalf("expected no transactions before window, got %d", len(p.Transactions))
+	}
+
+	for _, q := range []string{"state=draw", "status=unknown", "source=casino", "min_amount=1e2", "from=yesterday", "limit=0", "cursor=-1"} {
+		if code, _ := history(t, e, h, "history-user", q); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400 got %d", q, code)
+		}
+	}
+}
+
+func balance(t *testing.T, e *echo.Echo, h *Server, id, consistency string) (int, models.BalanceInfo) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/"+id+"/balance?consistency="+consistency, nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+
+	if err := h.UserBalance(c); err != nil {
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he.Code, models.BalanceInfo{}
+		}
+		t.Fatal(err)
+	}
+
+	var res struct {
+		Data models.BalanceInfo `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec.Code, res.Data
+}
+
+// cache is ahead of database until background workers save balances
+func TestServer_UserBalance(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "balance-user")
+	registerUser(t, e, h, "other-user")
+
+	process(e, h, "balance-user", `{"state": "win", "amount": "8.25", "transactionId": "b-1"}`)
+	process(e, h, "balance-user", `{"state": "win", "amount": "1", "transactionId": "b-2"}`)
+	process(e, h, "other-user", `{"state": "win", "amount": "1", "transactionId": "b-3"}`)
+
+	code, info := balance(t, e, h, "balance-user", "")
+	if code != http.StatusOK || info.Cache == nil || *info.Cache != 925 || info.Database == nil || *info.Database != 0 ||
+		!info.Unsaved || info.Pending != 2 || info.PendingTotal != 3 {
+		t.Fatalf("unexpected balance before save %d %+v", code, info)
+	}
+
+	if _, err := h.flushTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.flushBalances(); err != nil {
+		t.Fatal(err)
+	}
+
+	code, info = balance(t, e, h, "balance-user", "database")
+	if code != http.StatusOK || info.Cache != nil || info.Database == nil || *info.Database != 925 || info.Pending != 0 {
+		t.Fatalf("unexpected database balance %d %+v", code, info)
+	}
+
+	code, info = balance(t, e, h, "balance-user", "cache")
+	if code != http.StatusOK || info.Database != nil || info.Cache == nil || *info.Cache != 925 || info.Unsaved {
+		t.Fatalf("unexpected cache balance %d %+v", code, info)
+	}
+
+	if code, _ := balance(t, e, h, "unknown-user", "both"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 got %d", code)
+	}
+
+	if code, _ := balance(t, e, h, "balance-user", "eventual"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 got %d", code)
+	}
+}
+
+// admin api request with admin token. returns status code and api key from response
+func adminRequest(e *echo.Echo, handler echo.HandlerFunc, method, id, body string) (int, string) {
+	req := httptest.NewRequest(method, "/api/providers", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+testToken(RoleAdmin, "admin"))
+
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+
+	if err := handler(c); err != nil {
+		return err.(*echo.HTTPError).Code, ""
+	}
+
+	var res struct {
+		Data models.ProviderKey `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &res)
+
+	return rec.Code, res.Data.ApiKey
+}
+
+// api key of provider created, rotated and revoked with management api
+func TestServer_Providers(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "provider-user")
+
+	send := func(key, source, transactionId string) int {
+		body := withUser("provider-user", `{"state": "win", "amount": "1", "transactionId": "`+transactionId+`"}`)
+		req := httptest.NewRequest(http.MethodPost, "/api/processing", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Source-Type", source)
+		req.Header.Set(HeaderApiKey, key)
+
+		code, _ := serve(e, h.ProviderAuth(h.Handler), req)
+		return code
+	}
+
+	code, key := adminRequest(e, h.Auth(RoleAdmin)(h.CreateProvider), http.MethodPost, "", `{"name": "casino", "sourceTypes": ["game"]}`)
+	if code != http.StatusCreated || !strings.HasPrefix(key, "pk_") {
+		t.Fatalf("create provider: got %d %q", code, key)
+	}
+
+	if code, _ := adminRequest(e, h.Auth(RoleAdmin)(h.CreateProvider), http.MethodPost, "", `{"name": "bank", "sourceTypes": ["unknown"]}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown source type, got %d", code)
+	}
+
+	providers, _ := repo.FetchProviders()
+	if len(providers) != 1 || providers[0].KeyHash == key || providers[0].KeyHash != models.HashApiKey(key) {
+		t.Fatalf("api key must be saved as hash %+v", providers)
+	}
+	id := fmt.Sprint(providers[0].ID)
+
+	for _, c := range []struct {
+		key, source, transactionId string
+		code                       int
+	}{
+		{key, "game", "pr-1", http.StatusCreated},
+		{key, "payment", "pr-2", http.StatusForbidden},
+		{"", "game", "pr-3", http.StatusUnauthorized},
+		{"pk_wrong", "game", "pr-3", http.StatusUnauthorized},
+	} {
+		if code := send(c.key, c.source, c.transactionId); code != c.code {
+			t.Fatalf("%+v: got %d", c, code)
+		}
+	}
+
+	// provider reads only own transactions
+	status := func(auth, transactionId string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/transactions/"+transactionId, nil)
+		if strings.HasPrefix(auth, "pk_") {
+			req.Header.Set(HeaderApiKey, auth)
+		} else {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+auth)
+		}
+
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("transactionId")
+		c.SetParamValues(transactionId)
+
+		if err := h.Auth(RoleProvider, RoleAdmin)(h.TransactionStatus)(c); err != nil {
+			return err.(*echo.HTTPError).Code
+		}
+		return rec.Code
+	}
+
+	for _, c := range []struct {
+		auth string
+		code int
+	}{
+		{key, http.StatusOK},
+		{testApiKey, http.StatusNotFound},
+		{testToken(RoleAdmin, "admin"), http.StatusOK},
+	} {
+		if code := status(c.auth, "pr-1"); code != c.code {
+			t.Fatalf("status of pr-1 with %q: expected %d got %d", c.auth, c.code, code)
+		}
+	}
+
+	// rejected requests doesnt use transaction id
+	if code := send(key, "game", "pr-2"); code != http.StatusCreated {
+		t.Fatalf("expected 201 got %d", code)
+	}
+
+	code, rotated := adminRequest(e, h.Auth(RoleAdmin)(h.RotateProvider), http.MethodPost, id, "")
+	if code != http.StatusOK || rotated == "" || rotated == key {
+		t.Fatalf("rotate provider: got %d %q", code, rotated)
+	}
+
+	if code := send(key, "game", "pr-4"); code != http.StatusUnauthorized {
+		t.Fatalf("old api key must not work after rotate, got %d", code)
+	}
+
+	if code := send(rotated, "game", "pr-4"); code != http.StatusCreated {
+		t.Fatalf("expected 201 with rotated api key, got %d", code)
+	}
+
+	if code, _ := adminRequest(e, h.Auth(RoleAdmin)(h.RevokeProvider), http.MethodDelete, id, ""); code != http.StatusOK {
+		t.Fatalf("revoke provider: got %d", code)
+	}
+
+	if code := send(rotated, "game", "pr-5"); code != http.StatusUnauthorized {
+		t.Fatalf("revoked api key must not work, got %d", code)
+	}
+
+	// revoked after restart too
+	restarted := newTestServer(repo)
+	if err := restarted.FetchData(); err != nil {
+		t.Fatal(err)
+	}
+	h = restarted
+
+	if code := send(rotated, "game", "pr-5"); code != http.StatusUnauthorized {
+		t.Fatalf("revoked api key must not work after restart, got %d", code)
+	}
+
+	if code, _ := adminRequest(e, h.Auth(RoleAdmin)(h.RotateProvider), http.MethodPost, "404", ""); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown provider, got %d", code)
+	}
+}
+
+// signed requests of provider with hmac secret
+func TestServer_Signature(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "signed-user")
+
+	code, key := adminRequest(e, h.Auth(RoleAdmin)(h.CreateProvider), http.MethodPost, "", `{"name": "payments", "sourceTypes": ["game"], "signed": true}`)
+	if code != http.StatusCreated {
+		t.Fatalf("create provider: got %d", code)
+	}
+
+	providers, _ := repo.FetchProviders()
+	secret := providers[0].HmacSecret
+	if secret == "" || !providers[0].Signed {
+		t.Fatalf("expected hmac secret for signed provider %+v", providers[0])
+	}
+
+	send := func(body, ts, signature string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/processing", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Source-Type", "game")
+		req.Header.Set(HeaderApiKey, key)
+		req.Header.Set(HeaderTimestamp, ts)
+		req.Header.Set(HeaderSignature, signature)
+
+		code, _ := serve(e, h.ProviderAuth(h.SignatureAuth(h.Handler)), req)
+		return code
+	}
+
+	body := withUser("signed-user", `{"state": "win", "amount": "1", "transactionId": "s-1"}`)
+	now := fmt.Sprint(time.Now().Unix())
+	old := fmt.Sprint(time.Now().Add(-SignatureWindow - time.Minute).Unix())
+
+	for _, c := range []struct {
+		name           string
+		body, ts, sign string
+		code           int
+	}{
+		{"no signature", body, now, "", http.StatusUnauthorized},
+		{"wrong secret", body, now, models.Signature("wrong", now, []byte(body)), http.StatusUnauthorized},
+		{"changed body", strings.Replace(body, `"1"`, `"100"`, 1), now, models.Signature(secret, now, []byte(body)), http.StatusUnauthorized},
+		{"changed timestamp", body, old, models.Signature(secret, now, []byte(body)), http.StatusUnauthorized},
+		{"expired", body, old, models.Signature(secret, old, []byte(body)), http.StatusUnauthorized},
+		{"no timestamp", body, "", models.Signature(secret, "", []byte(body)), http.StatusUnauthorized},
+		{"signed", body, now, models.Signature(secret, now, []byte(body)), http.StatusCreated},
+	} {
+		if code := send(c.body, c.ts, c.sign); code != c.code {
+			t.Fatalf("%s: expected %d got %d", c.name, c.code, code)
+		}
+	}
+
+	// not signed after secret removed
+	if code, _ := adminRequest(e, h.Auth(RoleAdmin)(h.RemoveProviderSecret), http.MethodDelete, fmt.Sprint(providers[0].ID), ""); code != http.StatusOK {
+		t.Fatalf("remove secret: got %d", code)
+	}
+
+	body = withUser("signed-user", `{"state": "win", "amount": "1", "transactionId": "s-2"}`)
+	if code := send(body, "", ""); code != http.StatusCreated {
+		t.Fatalf("expected 201 without signature, got %d", code)
+	}
+
+	if u := h.UserBalances["signed-user"]; u.Amount != 200 {
+		t.Fatalf("expected balance 2.00 got %s", u.Amount)
+	}
+}
+
+// route level role enforcement
+func TestServer_Auth(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "auth-user")
+	registerUser(t, e, h, "other-user")
+
+	provider := h.Providers[models.HashApiKey(testApiKey)]
+	provider.ID = 7
+	h.setProvider(provider.KeyHash, provider)
+
+	expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, service.Claims{Role: RoleAdmin, RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   "admin",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+	}}).SignedString([]byte(testJwtSecret))
+
+	wrongSecret, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, service.Claims{Role: RoleAdmin, RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   "admin",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}).SignedString([]byte("wrong"))
+
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, service.Claims{Role: RoleAdmin, RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   "admin",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	balanceRoute := h.Auth(RoleUser, RoleAdmin)(h.OwnUser(h.UserBalance))
+	usersRoute := h.Auth(RoleAdmin)(h.FetchUsersForTesting)
+	processingRoute := h.ProviderAuth(h.Handler)
+
+	request := func(route echo.HandlerFunc, method, id, token, body string) int {
+		req := httptest.NewRequest(method, "/", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Source-Type", "game")
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+
+		if err := route(c); err != nil {
+			return err.(*echo.HTTPError).Code
+		}
+		return rec.Code
+	}
+
+	win := withUser("auth-user", `{"state": "win", "amount": "1", "transactionId": "auth-1"}`)
+
+	for _, c := range []struct {
+		name      string
+		route     echo.HandlerFunc
+		method    string
+		id, token string
+		body      string
+		code      int
+	}{
+		{"own balance", balanceRoute, http.MethodGet, "auth-user", testToken(RoleUser, "auth-user"), "", http.StatusOK},
+		{"other user balance", balanceRoute, http.MethodGet, "other-user", testToken(RoleUser, "auth-user"), "", http.StatusForbidden},
+		{"admin reads any balance", balanceRoute, http.MethodGet, "other-user", testToken(RoleAdmin, "admin"), "", http.StatusOK},
+		{"provider reads balance", balanceRoute, http.MethodGet, "auth-user", testToken(RoleProvider, "7"), "", http.StatusForbidden},
+		{"no token", balanceRoute, http.MethodGet, "auth-user", "", "", http.StatusUnauthorized},
+		{"users for admin", usersRoute, http.MethodGet, "", testToken(RoleAdmin, "admin"), "", http.StatusOK},
+		{"users for user", usersRoute, http.MethodGet, "", testToken(RoleUser, "auth-user"), "", http.StatusForbidden},
+		{"expired token", usersRoute, http.MethodGet, "", expired, "", http.StatusUnauthorized},
+		{"wrong secret", usersRoute, http.MethodGet, "", wrongSecret, "", http.StatusUnauthorized},
+		{"unsigned token", usersRoute, http.MethodGet, "", unsigned, "", http.StatusUnauthorized},
+		{"unknown role", usersRoute, http.MethodGet, "", testToken("root", "admin"), "", http.StatusUnauthorized},
+		{"admin posts transaction", processingRoute, http.MethodPost, "", testToken(RoleAdmin, "admin"), win, http.StatusForbidden},
+		{"user posts transaction", processingRoute, http.MethodPost, "", testToken(RoleUser, "auth-user"), win, http.StatusForbidden},
+		{"unknown provider", processingRoute, http.MethodPost, "", testToken(RoleProvider, "8"), win, http.StatusUnauthorized},
+		{"provider posts transaction", processingRoute, http.MethodPost, "", testToken(RoleProvider, "7"), win, http.StatusCreated},
+	} {
+		if code := request(c.route, c.method, c.id, c.token, c.body); code != c.code {
+			t.Fatalf("%s: expected %d got %d", c.name, c.code, code)
+		}
+	}
+}
+
+// source types added and disabled at runtime. ids of old transactions not changed
+func TestServer_SourceTypes(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "source-user")
+
+	provider := h.Providers[models.HashApiKey(testApiKey)]
+	provider.SourceTypes = "game,casino"
+	h.setProvider(provider.KeyHash, provider)
+
+	send := func(source, transactionId string) int {
+		body := withUser("source-user", `{"state": "win", "amount": "1", "transactionId": "`+transactionId+`"}`)
+		req := httptest.NewRequest(http.MethodPost, "/api/processing", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("Source-Type", source)
+		req.Header.Set(HeaderApiKey, testApiKey)
+
+		code, _ := serve(e, h.ProviderAuth(h.Handler), req)
+		return code
+	}
+
+	if code := send("game", "st-1"); code != http.StatusCreated {
+		t.Fatalf("expected 201 got %d", code)
+	}
+
+	if code := send("casino", "st-2"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for not registered source type, got %d", code)
+	}
+
+	admin := h.Auth(RoleAdmin)
+	if code, _ := adminRequest(e, admin(h.CreateSourceType), http.MethodPost, "", `{"name": "casino"}`); code != http.StatusCreated {
+		t.Fatalf("create source type: got %d", code)
+	}
+
+	if code, _ := adminRequest(e, admin(h.CreateSourceType), http.MethodPost, "", `{"name": "game"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for existing source type, got %d", code)
+	}
+
+	if code, _ := adminRequest(e, admin(h.UpdateSourceType), http.MethodPut, "0", `{"enabled": false}`); code != http.StatusOK {
+		t.Fatalf("disable source type: got %d", code)
+	}
+
+	if code, _ := adminRequest(e, admin(h.UpdateSourceType), http.MethodPut, "9", `{"enabled": false}`); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown source type, got %d", code)
+	}
+
+	if code := send("casino", "st-3"); code != http.StatusCreated {
+		t.Fatalf("expected 201 for new source type, got %d", code)
+	}
+
+	if code := send("game", "st-4"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for disabled source type, got %d", code)
+	}
+
+	if _, err := h.flushTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	// registry loaded from repository after restart
+	restarted := newTestServer(repo)
+	if err := restarted.FetchData(); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, source := range map[string]string{"st-1": "game", "st-3": "casino"} {
+		if code, info := transactionStatus(t, e, restarted, id); code != http.StatusOK || info.Source != source {
+			t.Fatalf("%s: expected source %s got %d %+v", id, source, code, info)
+		}
+	}
+
+	if code, page := history(t, e, restarted, "source-user", "source=game"); code != http.StatusOK || len(page.Transactions) != 1 {
+		t.Fatalf("expected 1 transaction of disabled source type, got %d %+v", code, page)
+	}
+
+	types, _ := repo.FetchSourceTypes()
+	if len(types) != 4 || types[3].ID != 3 || types[3].Name != "casino" || types[0].Enabled {
+		t.Fatalf("unexpected source types %+v", types)
+	}
+
+	if _, err := restarted.SourceTypes.IndexOf("game"); err == nil {
+		t.Fatal("game must be disabled after restart")
+	}
+}
+
+// allowed states, amount limits, negative balance and cancel rules of source types
+func TestServer_SourceRules(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		repo := service.NewMemoryRepository()
+		h := newTestServer(repo)
+		h.Durable = durable
+		e := echo.New()
+
+		registerUser(t, e, h, "rules-user")
+
+		admin := h.Auth(RoleAdmin)
+		for id, rules := range map[string]string{
+			"0": `{"rules": {"allowNegative": true}}`,
+			"1": `{"rules": {"notCancelable": true}}`,
+			"2": `{"rules": {"states": "win", "minAmount": "1", "maxAmount": "100"}}`,
+		} {
+			if code, _ := adminRequest(e, admin(h.UpdateSourceType), http.MethodPut, id, rules); code != http.StatusOK {
+				t.Fatalf("update rules of %s: got %d", id, code)
+			}
+		}
+
+		if code, _ := adminRequest(e, admin(h.UpdateSourceType), http.MethodPut, "2", `{"rules": {"minAmount": "10", "maxAmount": "5"}}`); code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for wrong limits, got %d", code)
+		}
+
+		send := func(source, body string) int {
+			req := httptest.NewRequest(http.MethodPost, "/api/processing", strings.NewReader(withUser("rules-user", body)))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.Header.Set("Source-Type", source)
+			req.Header.Set(HeaderApiKey, testApiKey)
+
+			code, _ := serve(e, h.ProviderAuth(h.Handler), req)
+			return code
+		}
+
+		for _, c := range []struct {
+			source, body string
+			code         int
+		}{
+			{"payment", `{"state": "lose", "amount": "5", "transactionId": "r-1"}`, http.StatusBadRequest},
+			{"payment", `{"state": "win", "amount": "0.99", "transactionId": "r-2"}`, http.StatusBadRequest},
+			{"payment", `{"state": "win", "amount": "100.01", "transactionId": "r-3"}`, http.StatusBadRequest},
+			{"payment", `{"state": "win", "amount": "100", "transactionId": "r-4"}`, http.StatusCreated},
+			{"game", `{"state": "lose", "amount": "150", "transactionId": "r-5"}`, http.StatusCreated},
+			{"server", `{"state": "lose", "amount": "150", "transactionId": "r-6"}`, http.StatusBadRequest},
+			{"server", `{"state": "win", "amount": "20", "transactionId": "r-7"}`, http.StatusCreated},
+		} {
+			if code := send(c.source, c.body); code != c.code {
+				t.Fatalf("durable %v %s %s: expected %d got %d", durable, c.source, c.body, c.code, code)
+			}
+		}
+
+		if b := h.UserBalances["rules-user"].Amount; b != -3000 {
+			t.Fatalf("durable %v: expected balance -30.00 got %s", durable, b)
+		}
+
+		if _, err := h.flushTransactions(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.cancelTransactions(); err != nil {
+			t.Fatal(err)
+		}
+
+		// latest odd records. server transactions never canceled
+		for id, status := range map[string]string{"r-4": "processed", "r-5": "canceled", "r-7": "processed"} {
+			if code, info := transactionStatus(t, e, h, id); code != http.StatusOK || info.Status != status {
+				t.Fatalf("durable %v %s: expected %s got %d %+v", durable, id, status, code, info)
+			}
+		}
+	}
+}
+
+// policy selecting given transaction ids
+type idsPolicy []string
+
+func (p idsPolicy) Candidates(repo service.Repository, exclude []int) ([]models.Data, error) {
+	data := make([]models.Data, 0)
+	for _, id := range p {
+		d, err := repo.FindTransaction(id)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, d)
+	}
+
+	return data, nil
+}
+
+func (p idsPolicy) String() string {
+	return "ids=" + strings.Join(p, ",")
+}
+
+// selection rules, batch size and schedule of post processing
+func TestServer_CancelPolicy(t *testing.T) {
+
+	sources := NewSourceTypes(models.DefaultSourceTypes)
+
+	for _, s := range []string{"parity=first", "limit=0", "source=unknown", "min_age=1", "max_amount=1e2", "size=10", "%"} {
+		if _, err := ParseCancelPolicy(s, sources); err == nil {
+			t.Fatalf("%s: expected error", s)
+		}
+	}
+
+	if p, err := ParseCancelPolicy("", sources); err != nil || p.Parity != models.ParityOdd || p.Limit != 10 {
+		t.Fatalf("expected default policy, got %+v %v", p, err)
+	}
+
+	cases := []struct {
+		policy string
+		ids    []string // canceled transactions
+	}{
+		{"", []string{"c-9", "c-7", "c-5", "c-3", "c-1"}},
+		{"limit=2", []string{"c-9", "c-7"}},
+		{"parity=even&limit=3", []string{"c-10", "c-8", "c-6"}},
+		{"parity=any&user=other-cancel-user", []string{"c-10", "c-9"}},
+		{"parity=any&min_amount=3&max_amount=5", []string{"c-5", "c-4", "c-3"}},
+		{"parity=any&max_age=1h", []string{"c-10", "c-9", "c-8", "c-7", "c-6", "c-5", "c-4", "c-3", "c-2", "c-1"}},
+		{"parity=any&min_age=1h", nil},
+	}
+
+	for _, c := range cases {
+		repo := service.NewMemoryRepository()
+		h := newTestServer(repo)
+		e := echo.New()
+
+		registerUser(t, e, h, "cancel-user")
+		registerUser(t, e, h, "other-cancel-user")
+
+		for i := 1; i <= 10; i++ {
+			user := "cancel-user"
+			if i > 8 {
+				user = "other-cancel-user"
+			}
+
+			body := fmt.Sprintf(`{"state": "win", "amount": "%d", "transactionId": "c-%d"}`, i, i)
+			if code, rec := process(e, h, user, body); code != http.StatusCreated {
+				t.Fatalf("%s: got %d %s", body, code, rec.Body.String())
+			}
+		}
+
+		if _, err := h.flushTransactions(); err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := ParseCancelPolicy(c.policy, h.SourceTypes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.CancelPolicy = p
+
+		if err := h.cancelTransactions(); err != nil {
+			t.Fatal(err)
+		}
+
+		canceled := make([]string, 0)
+		for i := 10; i >= 1; i-- {
+			id := fmt.Sprintf("c-%d", i)
+			if _, info := transactionStatus(t, e, h, id); info.Status == "canceled" {
+				canceled = append(canceled, id)
+			}
+		}
+
+		if strings.Join(canceled, ",") != strings.Join(c.ids, ",") {
+			t.Fatalf("%q: expected canceled %v got %v", c.policy, c.ids, canceled)
+		}
+	}
+
+	// custom policy
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "cancel-user")
+	process(e, h, "cancel-user", `{"state": "win", "amount": "1", "transactionId": "c-1"}`)
+	process(e, h, "cancel-user", `{"state": "win", "amount": "1", "transactionId": "c-2"}`)
+
+	if _, err := h.flushTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	h.CancelPolicy = idsPolicy{"c-2"}
+	if err := h.cancelTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, info := transactionStatus(t, e, h, "c-2"); info.Status != "canceled" {
+		t.Fatalf("expected canceled c-2, got %+v", info)
+	}
+
+	// schedules
+	now := time.Date(2021, 5, 1, 10, 7, 30, 0, time.UTC)
+	if next := Interval(5 * time.Minute).Next(now); !next.Equal(now.Add(5 * time.Minute)) {
+		t.Fatalf("unexpected interval next %v", next)
+	}
+
+	s, err := ParseSchedule("*/15 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if next := s.Next(now); !next.Equal(time.Date(2021, 5, 1, 10, 15, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected cron next %v", next)
+	}
+
+	if _, err := ParseSchedule("every five minutes"); err == nil {
+		t.Fatal("expected error for wrong cron expression")
+	}
+}
+
+// repository with failing cancel. database error after commit too
+type cancelFailRepo struct {
+	*service.MemoryRepository
+	fail   int  // count of failed cancels
+	commit bool // cancel saved before error
+}
+
+func (r *cancelFailRepo) CancelTransaction(data *models.Data, cancel *models.Cancellation) error {
+	if r.fail > 0 {
+		r.fail--
+		if r.commit {
+			r.MemoryRepository.CancelTransaction(data, cancel)
+		}
+		return fmt.Errorf("connection lost")
+	}
+
+	return r.MemoryRepository.CancelTransaction(data, cancel)
+}
+
+// buffered cancel applied once after failed database operations and restart
+func TestServer_CancelOnce(t *testing.T) {
+
+	for _, commit := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "transactions.wal")
+		repo := &cancelFailRepo{MemoryRepository: service.NewMemoryRepository(), commit: commit}
+		h := newTestServer(repo)
+		e := echo.New()
+
+		wal, err := service.OpenWAL(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Wal = wal
+
+		registerUser(t, e, h, "once-user")
+
+		// not inserted to database before post processing
+		process(e, h, "once-user", `{"state": "win", "amount": "30", "transactionId": "o-1"}`)
+		process(e, h, "once-user", `{"state": "win", "amount": "20", "transactionId": "o-2"}`)
+		process(e, h, "once-user", `{"state": "lose", "amount": "5", "transactionId": "o-3"}`)
+
+		h.CancelPolicy = idsPolicy{"o-1"}
+		repo.fail = 2
+
+		for i := 0; i < 3; i++ {
+			if err := h.cancelTransactions(); err != nil && i == 2 {
+				t.Fatal(err)
+			}
+
+			if b := h.UserBalances["once-user"].Amount; b != 1500 {
+				t.Fatalf("commit %v tick %d: expected balance 15.00 got %s", commit, i, b)
+			}
+		}
+
+		if _, info := transactionStatus(t, e, h, "o-1"); info.Status != "canceled" {
+			t.Fatalf("commit %v: expected canceled o-1, got %+v", commit, info)
+		}
+
+		if err := h.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if b := userBalance(t, repo, "once-user"); b != 1500 {
+			t.Fatalf("commit %v: expected saved balance 15.00 got %s", commit, b)
+		}
+
+		// crash after cancel accepted and before saved to database
+		h.CancelPolicy = idsPolicy{"o-3"}
+		repo.fail = 1
+		if err := h.cancelTransactions(); err != nil {
+			t.Fatal(err)
+		}
+		wal.Close()
+
+		wal, err = service.OpenWAL(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restarted := newTestServer(repo)
+		restarted.Wal = wal
+		if err := restarted.FetchData(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restarted.cancelTransactions(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restarted.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if b := userBalance(t, repo, "once-user"); b != 2000 {
+			t.Fatalf("commit %v: expected balance 20.00 after restart got %s", commit, b)
+		}
+
+		if _, info := transactionStatus(t, e, restarted, "o-3"); info.Status != "canceled" {
+			t.Fatalf("commit %v: expected canceled o-3, got %+v", commit, info)
+		}
+		wal.Close()
+	}
+}
+
+// balance saved between failed cancel save and retry. cancel not applied to saved balance again
+func TestServer_CancelBalanceFlush(t *testing.T) {
+
+	repo := &cancelFailRepo{MemoryRepository: service.NewMemoryRepository()}
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "flush-user")
+	process(e, h, "flush-user", `{"state": "win", "amount": "30", "transactionId": "f-1"}`)
+	process(e, h, "flush-user", `{"state": "win", "amount": "20", "transactionId": "f-2"}`)
+
+	h.CancelPolicy = idsPolicy{"f-1"}
+	repo.fail = 1
+	h.cancelTransactions()
+
+	if err := h.flushBalances(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.cancelTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := h.UserBalances["flush-user"].Amount; b != 2000 {
+		t.Fatalf("expected balance 20.00 got %s", b)
+	}
+
+	if b := userBalance(t, repo, "flush-user"); b != 2000 {
+		t.Fatalf("expected saved balance 20.00 got %s", b)
+	}
+}
+
+// record read before cancel saved. second cancel with stale record not applied again
+func TestServer_CancelStale(t *testing.T) {
+
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	registerUser(t, e, h, "stale-user")
+	process(e, h, "stale-user", `{"state": "win", "amount": "10", "transactionId": "s-1"}`)
+	process(e, h, "stale-user", `{"state": "win", "amount": "20", "transactionId": "s-2"}`)
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := repo.FindTransaction("s-1")
+	if err != nil || stale.Status != 1 {
+		t.Fatalf("expected processed record, got %+v %v", stale, err)
+	}
+
+	h.CancelPolicy = idsPolicy{"s-1"}
+	if err := h.cancelTransactions(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := models.NewCancellation(stale, "manual", "")
+	if err := h.cancel(&stale, &c); err != service.ErrAlreadyCanceled {
+		t.Fatalf("expected already canceled error, got %v", err)
+	}
+
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := userBalance(t, repo, "stale-user"); b != 2000 {
+		t.Fatalf("expected saved balance 20.00 got %s", b)
+	}
+}
+
+// applied and denied cancels saved as cancellations. denied record never selected again
+func TestServer_CancelAudit(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		repo := service.NewMemoryRepository()
+		h := newTestServer(repo)
+		h.Durable = durable
+		e := echo.New()
+
+		registerUser(t, e, h, "audit-user")
+		process(e, h, "audit-user", `{"state": "win", "amount": "30", "transactionId": "a-1"}`)
+		process(e, h, "audit-user", `{"state": "lose", "amount": "25", "transactionId": "a-2"}`)
+
+		// 5.00 - 30.00 --> denied
+		h.CancelPolicy = idsPolicy{"a-1"}
+		for i := 0; i < 2; i++ {
+			if err := h.cancelTransactions(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, info := transactionStatus(t, e, h, "a-1")
+		if info.Status != "cancel denied" || len(info.Cancellations) != 1 {
+			t.Fatalf("durable %v: expected one denied cancellation, got %+v", durable, info)
+		}
+
+		c := info.Cancellations[0]
+		if c.Outcome != models.CancelDenied || c.BalanceBefore != 500 || c.BalanceAfter != 500 || c.Policy != "ids=a-1" || c.Reason != models.ReasonPostProcessing {
+			t.Fatalf("durable %v: unexpected denied cancellation %+v", durable, c)
+		}
+
+		// 5.00 + 25.00
+		h.CancelPolicy = idsPolicy{"a-2"}
+		if err := h.cancelTransactions(); err != nil {
+			t.Fatal(err)
+		}
+
+		_, info = transactionStatus(t, e, h, "a-2")
+		if info.Status != "canceled" || len(info.Cancellations) != 1 {
+			t.Fatalf("durable %v: expected one applied cancellation, got %+v", durable, info)
+		}
+
+		c = info.Cancellations[0]
+		if c.Outcome != models.CancelApplied || c.BalanceBefore != 500 || c.BalanceAfter != 3000 || c.DataId != info.Id {
+			t.Fatalf("durable %v: unexpected applied cancellation %+v", durable, c)
+		}
+
+		if err := h.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if b := userBalance(t, repo, "audit-user"); b != 3000 {
+			t.Fatalf("durable %v: expected balance 30.00, got %s", durable, b)
+		}
+	}
+}
+
+func manualCancel(t *testing.T, e *echo.Echo, h *Server, token, id, body string) (int, models.Cancellation) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/transactions/"+id+"/cancel", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("transactionId")
+	c.SetParamValues(id)
+
+	var res struct {
+		Data models.Cancellation `json:"data"`
+	}
+
+	if err := h.Auth(RoleAdmin)(h.ManualCancel)(c); err != nil {
+		he := err.(*echo.HTTPError)
+		if r, ok := he.Message.(*models.Response); ok {
+			res.Data, _ = r.Data.(models.Cancellation)
+		}
+		return he.Code, res.Data
+	}
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec.Code, res.Data
+}
+
+// manual cancel with same rules as post processing. partial refund, requester and reason saved
+func TestServer_ManualCancel(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		repo := service.NewMemoryRepository()
+		h := newTestServer(repo)
+		h.Durable = durable
+		e := echo.New()
+		admin := testToken(RoleAdmin, "operator")
+
+		registerUser(t, e, h, "manual-user")
+		process(e, h, "manual-user", `{"state": "win", "amount": "30", "transactionId": "m-1"}`)
+		process(e, h, "manual-user", `{"state": "lose", "amount": "25", "transactionId": "m-2"}`)
+
+		for _, c := range []struct {
+			token, id, body string
+			code            int
+		}{
+			{admin, "m-1", `{}`, http.StatusBadRequest},
+			{admin, "m-0", `{"reason": "test"}`, http.StatusNotFound},
+			{testToken(RoleUser, "manual-user"), "m-1", `{"reason": "test"}`, http.StatusForbidden},
+			{admin, "m-2", `{"reason": "test", "amount": "25.01"}`, http.StatusBadRequest},
+			{admin, "m-2", `{"reason": "test", "amount": "0"}`, http.StatusBadRequest},
+		} {
+			if code, _ := manualCancel(t, e, h, c.token, c.id, c.body); code != c.code {
+				t.Fatalf("durable %v: cancel %s %s: expected %d, got %d", durable, c.id, c.body, c.code, code)
+			}
+		}
+
+		// 5.00 - 30.00 --> denied
+		code, cancel := manualCancel(t, e, h, admin, "m-1", `{"reason": "chargeback"}`)
+		if code != http.StatusBadRequest || cancel.Outcome != models.CancelDenied {
+			t.Fatalf("durable %v: expected denied cancel, got %d %+v", durable, code, cancel)
+		}
+
+		// buffered transaction not inserted yet. 55.00 - 20.00
+		process(e, h, "manual-user", `{"state": "win", "amount": "50", "transactionId": "m-3"}`)
+
+		code, cancel = manualCancel(t, e, h, admin, "m-3", `{"reason": "partial refund", "amount": "20"}`)
+		if code != http.StatusOK || cancel.Amount != 2000 || cancel.BalanceAfter != 3500 || cancel.Requester != "operator" || cancel.Reason != "partial refund" {
+			t.Fatalf("durable %v: unexpected partial cancel %d %+v", durable, code, cancel)
+		}
+
+		if code, _ := manualCancel(t, e, h, admin, "m-3", `{"reason": "again"}`); code != http.StatusConflict {
+			t.Fatalf("durable %v: expected 409 for canceled record, got %d", durable, code)
+		}
+
+		// denied before. 35.00 - 30.00
+		code, cancel = manualCancel(t, e, h, admin, "m-1", `{"reason": "chargeback"}`)
+		if code != http.StatusOK || cancel.BalanceAfter != 500 {
+			t.Fatalf("durable %v: expected cancel of denied record, got %d %+v", durable, code, cancel)
+		}
+
+		if _, info := transactionStatus(t, e, h, "m-1"); info.Status != "canceled" || len(info.Cancellations) != 2 {
+			t.Fatalf("durable %v: expected denied and applied cancellations, got %+v", durable, info)
+		}
+
+		if err := h.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if b := userBalance(t, repo, "manual-user"); b != 500 {
+			t.Fatalf("durable %v: expected balance 5.00, got %s", durable, b)
+		}
+	}
+}
+
+// repository reading records for concurrent cancels. every reader waits until all read same record
+type findBarrierRepo struct {
+	*service.MemoryRepository
+	wait *sync.WaitGroup
+}
+
+func (r *findBarrierRepo) FindTransaction(id string) (models.Data, error) {
+	d, err := r.MemoryRepository.FindTransaction(id)
+	if r.wait != nil {
+		r.wait.Done()
+		r.wait.Wait()
+	}
+
+	return d, err
+}
+
+// two manual cancels of same record at same time in buffered mode. balance changed once
+func TestServer_ConcurrentCancel(t *testing.T) {
+
+	repo := &findBarrierRepo{MemoryRepository: service.NewMemoryRepository()}
+	h := newTestServer(repo)
+	e := echo.New()
+	admin := testToken(RoleAdmin, "operator")
+
+	registerUser(t, e, h, "race-user")
+	process(e, h, "race-user", `{"state": "win", "amount": "50", "transactionId": "c-0"}`)
+
+	for i := 1; i <= 20; i++ {
+		id := fmt.Sprintf("c-%d", i)
+		process(e, h, "race-user", `{"state": "win", "amount": "1", "transactionId": "`+id+`"}`)
+		if err := h.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		// both cancels read processed record before any cancel saved
+		repo.wait = &sync.WaitGroup{}
+		repo.wait.Add(2)
+
+		codes := make(chan int, 2)
+		for k := 0; k < 2; k++ {
+			go func() {
+				code, _ := manualCancel(t, e, h, admin, id, `{"reason": "race"}`)
+				codes <- code
+			}()
+		}
+
+		first, second := <-codes, <-codes
+		repo.wait = nil
+
+		if first+second != http.StatusOK+http.StatusConflict {
+			t.Fatalf("%s: expected one 200 and one 409, got %d %d", id, first, second)
+		}
+
+		if b := h.UserBalances["race-user"].Amount; b != 5000 {
+			t.Fatalf("%s: expected balance 50.00, got %s", id, b)
+		}
+	}
+
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := userBalance(t, repo, "race-user"); b != 5000 {
+		t.Fatalf("expected saved balance 50.00, got %s", b)
+	}
+}
+
+// singleton jobs run by one instance. other instance takes them when leader stops
+func TestServer_Leader(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	lock := new(service.MemoryLock)
+
+	var running, max int32
+	job := func(ctx context.Context) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+
+		<-ctx.Done()
+		atomic.AddInt32(&running, -1)
+	}
+
+	servers := make([]*Server, 2)
+	stops := make([]context.CancelFunc, 2)
+	var wg sync.WaitGroup
+	for k := range servers {
+		h := newTestServer(repo)
+		h.Durable = true
+		h.LeaderInterval = 5 * time.Millisecond
+		servers[k] = h
+
+		ctx, cancel := context.WithCancel(context.Background())
+		stops[k] = cancel
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Leader(ctx, lock.Handle(), job, job)
+		}()
+	}
+
+	// index of leading server. waits until one server leads
+	leader := func() int {
+		t.Helper()
+
+		for i := 0; i < 200; i++ {
+			for k, h := range servers {
+				if h.Leading() {
+					return k
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		t.Fatal("no leader elected")
+		return -1
+	}
+
+	first := leader()
+	time.Sleep(50 * time.Millisecond)
+	if servers[1-first].Leading() {
+		t.Fatal("both servers leading")
+	}
+
+	// leader stopped. other server takes jobs
+	current := first
+	stops[current]()
+	for i := 0; i < 200 && !servers[1-current].Leading(); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if !servers[1-current].Leading() || servers[current].Leading() {
+		t.Fatal("expected failover to other server")
+	}
+
+	stops[1-current]()
+	wg.Wait()
+
+	if max != 2 || running != 0 {
+		t.Fatalf("expected jobs of one leader at same time, max %d running %d", max, running)
+	}
+
+	// lost lock. jobs stopped and started again after lock taken
+	h := newTestServer(repo)
+	h.LeaderInterval = 5 * time.Millisecond
+
+	var starts int32
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.Leader(ctx, lock.Handle(), func(ctx context.Context) {
+			atomic.AddInt32(&starts, 1)
+			<-ctx.Done()
+		})
+		close(done)
+	}()
+
+	for i := 0; i < 200 && atomic.LoadInt32(&starts) < 2; i++ {
+		if i%20 == 0 {
+			lock.Break()
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	if atomic.LoadInt32(&starts) < 2 {
+		t.Fatal("expected jobs started again after lost lock")
+	}
+}
+
+// every balance change posted to ledger. users.balance same as sum of user account postings
+func TestServer_Ledger(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		repo := service.NewMemoryRepository()
+		h := newTestServer(repo)
+		h.Durable = durable
+		e := echo.New()
+
+		p := h.Providers[models.HashApiKey(testApiKey)]
+		p.ID = 7
+		h.setProvider(p.KeyHash, p)
+
+		req := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(`{"UserId": "ledger-user", "Balance": "10"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if code, _ := serve(e, h.Register, req); code != http.StatusOK {
+			t.Fatalf("durable %v: register got %d", durable, code)
+		}
+
+		process(e, h, "ledger-user", `{"state": "win", "amount": "30", "transactionId": "l-1"}`)
+		process(e, h, "ledger-user", `{"state": "lose", "amount": "5", "transactionId": "l-2"}`)
+
+		if code, _ := manualCancel(t, e, h, testToken(RoleAdmin, "operator"), "l-1", `{"reason": "refund", "amount": "20"}`); code != http.StatusOK {
+			t.Fatalf("durable %v: manual cancel got %d", durable, code)
+		}
+
+		h.CancelPolicy = idsPolicy{"l-2"}
+		if err := h.cancelTransactions(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := h.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		lines, err := repo.UserLedger("ledger-user")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kinds := make([]string, 0)
+		for _, v := range lines {
+			kinds = append(kinds, v.Kind)
+		}
+
+		// 10.00 + 30.00 - 5.00 - 20.00 + 5.00
+		if strings.Join(kinds, ",") != "opening,transaction,transaction,cancel,cancel" || lines[len(lines)-1].Balance != 2000 {
+			t.Fatalf("durable %v: unexpected ledger %+v", durable, lines)
+		}
+
+		if b := userBalance(t, repo, "ledger-user"); b != 2000 {
+			t.Fatalf("durable %v: expected balance 20.00, got %s", durable, b)
+		}
+
+		report, err := repo.CheckLedger()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if report.Entries != 5 || len(report.Unbalanced) != 0 || len(report.Users) != 0 || report.Accounts["provider:7"] != -1000 || report.Accounts["house"] != -1000 {
+			t.Fatalf("durable %v: unexpected ledger report %+v", durable, report)
+		}
+
+		// user reads only own ledger
+		req = httptest.NewRequest(http.MethodGet, "/api/users/ledger-user/ledger", nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+testToken(RoleUser, "other-user"))
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues("ledger-user")
+
+		if err := h.Auth(RoleUser, RoleAdmin)(h.OwnUser(h.UserLedger))(c); err == nil || err.(*echo.HTTPError).Code != http.StatusForbidden {
+			t.Fatalf("durable %v: expected 403 for ledger of other user, got %v", durable, err)
+		}
+
+		if durable {
+			continue
+		}
+
+		// cache balance with not inserted transaction ahead of ledger. saved after transaction posted
+		process(e, h, "ledger-user", `{"state": "win", "amount": "1", "transactionId": "l-3"}`)
+		if err := h.flushBalances(); err != nil {
+			t.Fatal(err)
+		}
+
+		if b := userBalance(t, repo, "ledger-user"); b != 2000 || !h.UserBalances["ledger-user"].Saved {
+			t.Fatalf("expected balance 20.00 held until insert, got %s %+v", b, h.UserBalances["ledger-user"])
+		}
+
+		if err := h.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if b := userBalance(t, repo, "ledger-user"); b != 2100 {
+			t.Fatalf("expected balance 21.00 after insert, got %s", b)
+		}
+
+		// cache balance not explained by ledger never written
+		h.Mu.Lock()
+		h.UserBalances["ledger-user"] = models.Balance{Amount: 9900, Saved: true}
+		h.Balance = true
+		h.Mu.Unlock()
+
+		if err := h.flushBalances(); err != nil {
+			t.Fatal(err)
+		}
+
+		letters, err := repo.FetchDeadLetters()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b := userBalance(t, repo, "ledger-user"); b != 2100 || len(letters) != 1 || letters[0].Kind != models.DeadLetterBalance {
+			t.Fatalf("expected balance 21.00 and dead letter of balance, got %s %+v", b, letters)
+		}
+	}
+}
+
+func TestServer_Reconcile(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		repo := service.NewMemoryRepository()
+		h := newTestServer(repo)
+		h.Durable = durable
+		e := echo.New()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(`{"UserId": "rec-user", "Balance": "10"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if code, _ := serve(e, h.Register, req); code != http.StatusOK {
+			t.Fatalf("durable %v: register got %d", durable, code)
+		}
+		registerUser(t, e, h, "rec-other")
+
+		process(e, h, "rec-user", `{"state": "win", "amount": "30", "transactionId": "r-1"}`)
+		process(e, h, "rec-user", `{"state": "lose", "amount": "5", "transactionId": "r-2"}`)
+		process(e, h, "rec-other", `{"state": "win", "amount": "1", "transactionId": "r-3"}`)
+
+		if code, _ := manualCancel(t, e, h, testToken(RoleAdmin, "operator"), "r-1", `{"reason": "refund", "amount": "20"}`); code != http.StatusOK {
+			t.Fatalf("durable %v: manual cancel got %d", durable, code)
+		}
+
+		if err := h.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := h.Reconcile(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if report.Users != 2 || len(report.Discrepancies) != 0 {
+			t.Fatalf("durable %v: expected no discrepancies, got %+v", durable, report)
+		}
+
+		// database and cache drifted from records. 10.00 + 30.00 - 5.00 - 20.00
+		if err := repo.RepairBalance("rec-user", 1500, 5000); err != nil {
+			t.Fatal(err)
+		}
+		h.UserBalances["rec-user"] = models.Balance{Amount: 7000}
+
+		report, err = h.Reconcile(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(report.Discrepancies) != 1 {
+			t.Fatalf("durable %v: expected 1 discrepancy, got %+v", durable, report)
+		}
+
+		d := report.Discrepancies[0]
+		if d.UserId != "rec-user" || d.Expected != 1500 || d.Database != 5000 || d.Cache == nil || *d.Cache != 7000 || d.Pending || d.Repaired {
+			t.Fatalf("durable %v: unexpected discrepancy %+v", durable, d)
+		}
+
+		// csv report
+		req = httptest.NewRequest(http.MethodGet, "/api/reconciliation?format=csv", nil)
+		code, rec := serve(e, h.ReconciliationReport, req)
+		if code != http.StatusOK || rec.Body.String() != "userId,expected,database,cache,pending,repaired\nrec-user,15.00,50.00,70.00,false,false\n" {
+			t.Fatalf("durable %v: unexpected csv report %d %q", durable, code, rec.Body.String())
+		}
+
+		report, err = h.Reconcile(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(report.Discrepancies) != 1 || !report.Discrepancies[0].Repaired {
+			t.Fatalf("durable %v: expected repaired discrepancy, got %+v", durable, report)
+		}
+
+		if b := userBalance(t, repo, "rec-user"); b != 1500 || h.UserBalances["rec-user"].Amount != 1500 {
+			t.Fatalf("durable %v: expected repaired balance 15.00, got %s and cache %s", durable, b, h.UserBalances["rec-user"].Amount)
+		}
+
+		if report, err = h.Reconcile(false); err != nil || len(report.Discrepancies) != 0 {
+			t.Fatalf("durable %v: expected no discrepancies after repair, got %+v %v", durable, report, err)
+		}
+
+		// repair posted as adjustment. ledger still explains users.balance
+		ledger, err := repo.CheckLedger()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ledger.Users) != 0 || len(ledger.Unbalanced) != 0 {
+			t.Fatalf("durable %v: expected ledger matching balances after repair, got %+v", durable, ledger)
+		}
+
+		if durable {
+			continue
+		}
+
+		// buffered transaction not saved yet. difference is temporary and not repaired
+		process(e, h, "rec-other", `{"state": "win", "amount": "2", "transactionId": "r-4"}`)
+
+		report, err = h.Reconcile(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(report.Discrepancies) != 1 || !report.Discrepancies[0].Pending || report.Discrepancies[0].Repaired {
+			t.Fatalf("expected pending discrepancy, got %+v", report)
+		}
+
+		if err := h.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if report, err = h.Reconcile(false); err != nil || len(report.Discrepancies) != 0 {
+			t.Fatalf("expected no discrepancies after flush, got %+v %v", report, err)
+		}
+	}
+}
+
+// buffered repair logged. database not repaired for cache changed after check
+func TestServer_ReconcileWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transactions.wal")
+
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	wal, err := service.OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Wal = wal
+
+	registerUser(t, e, h, "wal-rec")
+	process(e, h, "wal-rec", `{"state": "win", "amount": "30", "transactionId": "rw-1"}`)
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// database and logged cache drifted from records
+	if err := repo.RepairBalance("wal-rec", 3000, 5000); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Mu.Lock()
+	data, drift := models.Data{UserId: "wal-rec"}, models.Money(5000)
+	h.writeWAL(service.WALBalance, &data, &drift, nil)
+	h.UserBalances["wal-rec"] = models.Balance{Amount: drift}
+	h.Mu.Unlock()
+
+	report, err := h.Reconcile(false)
+	if err != nil || len(report.Discrepancies) != 1 {
+		t.Fatalf("expected 1 discrepancy, got %+v %v", report, err)
+	}
+
+	// cache changed after check
+	process(e, h, "wal-rec", `{"state": "win", "amount": "1", "transactionId": "rw-2"}`)
+	if err := h.repair(&report.Discrepancies[0]); err != service.ErrBalanceChanged {
+		t.Fatalf("expected balance changed error, got %v", err)
+	}
+
+	if b := userBalance(t, repo, "wal-rec"); b != 5000 {
+		t.Fatalf("expected not repaired database balance 50.00, got %s", b)
+	}
+
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if report, err = h.Reconcile(true); err != nil || len(report.Discrepancies) != 1 || !report.Discrepancies[0].Repaired {
+		t.Fatalf("expected repaired discrepancy, got %+v %v", report, err)
+	}
+	wal.Close()
+
+	// restart. repaired balance restored from log and saved
+	wal, err = service.OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	restarted := newTestServer(repo)
+	restarted.Wal = wal
+	if err := restarted.FetchData(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b := restarted.UserBalances["wal-rec"]; b.Amount != 3100 {
+		t.Fatalf("expected repaired balance 31.00 after restart, got %+v", b)
+	}
+
+	if err := restarted.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err := repo.FetchDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := userBalance(t, repo, "wal-rec"); b != 3100 || len(letters) != 0 {
+		t.Fatalf("expected saved balance 31.00 without dead letters, got %s %+v", b, letters)
+	}
+}
+
+// repository with failing balance updates. batches with bad user never written
+type balanceFailRepo struct {
+	*service.MemoryRepository
+	bad     string
+	fail    int // count of failed updates before success. connection lost
+	batches int // count of update calls
+}
+
+func (r *balanceFailRepo) UpdateBalances(balances []models.UserBalance) error {
+	r.batches++
+	if r.fail > 0 {
+		r.fail--
+		return fmt.Errorf("connection lost")
+	}
+
+	for _, b := range balances {
+		if b.UserId == r.bad {
+			return fmt.Errorf("invalid user id: %w", service.ErrBadRow)
+		}
+	}
+
+	return r.MemoryRepository.UpdateBalances(balances)
+}
+
+// bad row isolated by bisecting batch. other balances saved, bad row saved to dead letters
+func TestServer_BalanceDeadLetter(t *testing.T) {
+	repo := &balanceFailRepo{MemoryRepository: service.NewMemoryRepository(), bad: "user-'quoted", fail: 1}
+	h := newTestServer(repo)
+	e := echo.New()
+
+	users := []string{"user-1", "user-2", "user-'quoted", "user-3", "user-4"}
+	for _, id := range users {
+		registerUser(t, e, h, id)
+		process(e, h, id, `{"state": "win", "amount": "10", "transactionId": "dl-`+id+`"}`)
+	}
+
+	if err := h.flushBuffered(); err != nil {
+		t.Fatal(err)
+	}
+
+	// connection lost. balances saved next time
+	if err := h.flushBalances(); err == nil {
+		t.Fatal("expected error of failed update")
+	}
+
+	h.Mu.Lock()
+	unsaved := h.Balance && h.UserBalances["user-1"].Saved
+	h.Mu.Unlock()
+	if !unsaved {
+		t.Fatal("balances of failed update must be saved again")
+	}
+
+	if err := h.flushBalances(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range users {
+		expected := models.Money(1000)
+		if id == repo.bad {
+			expected = 0
+		}
+
+		if b := userBalance(t, repo, id); b != expected {
+			t.Fatalf("user %s: expected balance %s, got %s", id, expected, b)
+		}
+	}
+
+	letters, err := repo.FetchDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(letters) != 1 || letters[0].Kind != models.DeadLetterBalance || letters[0].Key != `"user-'quoted"` || letters[0].Payload != `{"UserId":"user-'quoted","Amount":"10.00"}` {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+
+	// dead letter not retried
+	batches := repo.batches
+	if err := h.flushBalances(); err != nil || repo.batches != batches {
+		t.Fatalf("expected nothing to save, got %d updates %v", repo.batches-batches, err)
+	}
+}
+
+// full batch inserted at once. smaller batch waits for delay
+func TestServer_InsertThresholds(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	h.InsertBatch = 10
+	h.InsertDelay = time.Hour
+	e := echo.New()
+
+	registerUser(t, e, h, "batch-user")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.BulkInsertTransactions(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 13; i++ {
+		process(e, h, "batch-user", fmt.Sprintf(`{"state": "win", "amount": "1", "transactionId": "b-%d"}`, i))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.QueueDepth() != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if d := h.QueueDepth(); d != 3 {
+		t.Fatalf("expected 3 transactions waiting for delay, got %d", d)
+	}
+
+	cancel()
+	<-done
+
+	// short delay. not full batch inserted
+	h.InsertDelay = 20 * time.Millisecond
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go h.BulkInsertTransactions(ctx)
+
+	deadline = time.Now().Add(5 * time.Second)
+	for h.QueueDepth() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	transactions, err := repo.FetchTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.QueueDepth() != 0 || len(transactions) != 13 {
+		t.Fatalf("expected all 13 transactions inserted, got %d and %d waiting", len(transactions), h.QueueDepth())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/queue", nil)
+	code, rec := serve(e, h.InsertQueue, req)
+	if code != http.StatusOK || !strings.Contains(rec.Body.String(), `"depth":0,"batch":10,"delay":"20ms","inserted":13`) {
+		t.Fatalf("unexpected queue info %d %s", code, rec.Body.String())
+	}
+}
+
+// accepted transactions per second of buffered mode with bulk insert running
+func BenchmarkServer_Buffered(b *testing.B) {
+	repo := service.NewMemoryRepository()
+	h := newTestServer(repo)
+	e := echo.New()
+
+	h.UserBalances["bench-user"] = models.Balance{Amount: 1 << 40}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.BulkInsertTransactions(ctx)
+
+	var n int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id := atomic.AddInt64(&n, 1)
+			process(e, h, "bench-user", fmt.Sprintf(`{"state": "win", "amount": "1", "transactionId": "bench-%d"}`, id))
+		}
+	})
+}
+
+// repository with failing bulk inserts. error after commit too
+type insertFailRepo struct {
+	*service.MemoryRepository
+	mu     sync.Mutex
+	calls  int
+	bad    string // transaction id which can never be inserted
+	lookup bool   // lookup after lost commit result fails too
+	lost   bool   // commit result lost. next lookup fails
+	failed int    // count of failed lookups
+}
+
+func (r *insertFailRepo) InsertTransactions(transactions []models.Data) error {
+	for _, v := range transactions {
+		if v.TransactionId == r.bad {
+			return fmt.Errorf("invalid transaction id: %w", service.ErrBadRow)
+		}
+	}
+
+	r.mu.Lock()
+	r.calls++
+	calls := r.calls
+	r.mu.Unlock()
+
+	switch {
+	case calls%3 == 0:
+		return fmt.Errorf("connection lost")
+	case calls%5 == 0:
+		// committed. result of commit not received
+		r.MemoryRepository.InsertTransactions(transactions)
+		r.mu.Lock()
+		r.lost = r.lookup
+		r.mu.Unlock()
+		return fmt.Errorf("connection lost after commit")
+	}
+
+	return r.MemoryRepository.InsertTransactions(transactions)
+}
+
+func (r *insertFailRepo) FindTransaction(transactionId string) (models.Data, error) {
+	r.mu.Lock()
+	lost := r.lost
+	r.lost = false
+	r.mu.Unlock()
+
+	if lost {
+		r.mu.Lock()
+		r.failed++
+		r.mu.Unlock()
+		return models.Data{}, fmt.Errorf("connection lost")
+	}
+
+	return r.MemoryRepository.FindTransaction(transactionId)
+}
+
+// concurrent requests while bulk insert fails. every accepted transaction saved once
+func TestServer_ConcurrentInsert(t *testing.T) {
+	for _, bad := range []string{"", "q-3-7"} {
+		concurrentInsert(t, bad, false)
+	}
+}
+
+// commit result lost and lookup of committed batch failed. retried batch has saved transaction ids
+// saved transactions counted as inserted with concurrent flushes, not dead lettered or inserted twice
+func TestServer_ConcurrentInsertLookup(t *testing.T) {
+	concurrentInsert(t, "", true)
+}
+
+// bad transaction saved to dead letters. queue not blocked by it
+// lookup --> lookup after lost commit result fails. flushed by second flusher too
+func concurrentInsert(t *testing.T, bad string, lookup bool) {
+	repo := &insertFailRepo{MemoryRepository: service.NewMemoryRepository(), bad: bad, lookup: lookup}
+	h := newTestServer(repo)
+	h.InsertBatch = 7
+	h.InsertDelay = time.Millisecond
+	e := echo.New()
+
+	const users, count = 8, 150
+	for u := 0; u < users; u++ {
+		registerUser(t, e, h, fmt.Sprintf("queue-user-%d", u))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.BulkInsertTransactions(ctx)
+		close(done)
+	}()
+
+	// second flusher. same as flush of manual cancel
+	flushed := make(chan struct{})
+	go func() {
+		for lookup && ctx.Err() == nil {
+			h.flushTransactions()
+		}
+		close(flushed)
+	}()
+
+	var wg sync.WaitGroup
+	for u := 0; u < users; u++ {
+		wg.Add(1)
+		go func(u int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				body := fmt.Sprintf(`{"state": "win", "amount": "1", "transactionId": "q-%d-%d"}`, u, i)
+				if code, rec := process(e, h, fmt.Sprintf("queue-user-%d", u), body); code != http.StatusCreated {
+					t.Errorf("expected 201 got %d %s", code, rec.Body.String())
+					return
+				}
+			}
+		}(u)
+	}
+	wg.Wait()
+
+	cancel()
+	<-done
+	<-flushed
+
+	// rest saved on shutdown. failed flush retried same as worker
+	for i := 0; h.QueueDepth() > 0 && i < users*count; i++ {
+		h.Flush()
+	}
+
+	if err := h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	transactions, err := repo.FetchTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, v := range transactions {
+		if seen[v.TransactionId] {
+			t.Fatalf("transaction %s inserted twice", v.TransactionId)
+		}
+		seen[v.TransactionId] = true
+	}
+
+	saved := users * count
+	if bad != "" {
+		saved--
+	}
+
+	if len(seen) != saved || seen[bad] || h.QueueDepth() != 0 {
+		t.Fatalf("expected %d transactions saved, got %d and %d in queue", saved, len(seen), h.QueueDepth())
+	}
+
+	letters, err := repo.FetchDeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bad == "" && len(letters) != 0 {
+		t.Fatalf("expected no dead letters, got %+v", letters)
+	}
+
+	if lookup && repo.failed == 0 {
+		t.Fatal("expected failed lookups after lost commit result")
+	}
+
+	if bad != "" && (len(letters) != 1 || letters[0].Kind != models.DeadLetterTransaction || letters[0].Key != fmt.Sprintf("%q", bad)) {
+		t.Fatalf("expected dead letter of %s, got %+v", bad, letters)
+	}
+
+	// balance of dead letter transaction kept in cache and saved with balance update
+	for u := 0; u < users; u++ {
+		if b := userBalance(t, repo, fmt.Sprintf("queue-user-%d", u)); b != count*100 {
+			t.Fatalf("user %d: expected balance %d.00, got %s", u, count, b)
+		}
+	}
+
+	// dead letter transaction posted as adjustment. saved balances explained by ledger
+	report, err := repo.CheckLedger()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Users) != 0 || len(report.Unbalanced) != 0 {
+		t.Fatalf("expected balances equal to ledger, got %+v", report)
+	}
+}
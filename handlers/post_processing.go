@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"context"
 	"github.com/SaCavid/simple-task/models"
+	"github.com/SaCavid/simple-task/service"
 	"log"
 	"os"
 	"strconv"
@@ -11,62 +13,211 @@ import (
 // Post processing task:
 // Every N minutes 10 latest odd records must be canceled and balance should be corrected by the application.
 // Cancelled records shouldn't be processed twice.
-func (h *Server) PostProcessing() {
+// selection and schedule can be changed with CancelPolicy and CancelSchedule
+// stops when ctx canceled
+func (h *Server) PostProcessing(ctx context.Context) {
 
-	t := os.Getenv("N_MINUTES")
+	schedule := h.CancelSchedule
+	if schedule == nil {
+		t := os.Getenv("N_MINUTES")
 
-	m, err := strconv.ParseInt(t, 10, 64)
-	if err != nil {
-		log.Println(err)
-		m = 10
-	}
+		m, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			log.Println(err)
+			m = 10
+		}
 
-	for {
-		time.Sleep(time.Duration(m) * time.Minute)
+		schedule = Interval(time.Duration(m) * time.Minute)
+	}
 
-		var data []models.Data
+	for sleep(ctx, time.Until(schedule.Next(time.Now()))) {
 
-		// get latest 10 odd records
-		err := h.Repo.Db.Table("data").Where("MOD (id, 2) = 1").Order("id  DESC").Limit("10").Find(&data).Error
-		if err != nil {
+		if err := h.cancelTransactions(); err != nil {
 			log.Println("Post Processing:", err)
+		}
+	}
+}
+
+// cancel records selected by policy and correct user balances
+// record status and user balance changed in one database transaction only if record still processed
+// so every cancel applied once even after restart or failed database operation
+func (h *Server) cancelTransactions() error {
+
+	if !h.Durable {
+		// cancels accepted before and not saved to database
+		if err := h.saveCancels(); err != nil {
+			return err
+		}
+
+		// buffered transactions inserted first. latest records can be selected
+		if err := h.flushBuffered(); err != nil {
+			return err
+		}
+	}
+
+	policy := h.CancelPolicy
+	if policy == nil {
+		policy = DefaultCancelPolicy()
+	}
+
+	// default latest 10 odd records. source types not cancelable by rules skipped
+	data, err := policy.Candidates(h.Repo, h.SourceTypes.NotCancelable())
+	if err != nil {
+		return err
+	}
+
+	for _, v := range data {
+
+		// check if its not canceled before or not transaction record with error. denied before --> only manual cancel
+		if v.Status != 1 {
 			continue
 		}
 
-		for _, v := range data {
-
-			// check if its not canceled before or not transaction record with error
-			if v.Status == 1 {
-				h.Mu.Lock()
-				b := h.UserBalances[v.UserId]
-
-				if v.State { // win transaction
-					if b.Amount-v.Amount < 0 {
-						log.Println("Cancel not accepted. balance cant be negative.")
-						h.Mu.Unlock()
-						continue
-					}
-
-					b.Amount = b.Amount - v.Amount
-					b.Saved = true
-					h.UserBalances[v.UserId] = b
-					h.Balance = true
-				} else { // lose transaction
-					b.Amount = b.Amount + v.Amount
-					b.Saved = true
-					h.UserBalances[v.UserId] = b
-					h.Balance = true
-				}
-
-				h.Mu.Unlock()
-				v.Status = 3 // transaction status canceled - 3
-
-				err = h.Repo.Db.Save(&v).Error
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-			}
+		c := models.NewCancellation(v, models.ReasonPostProcessing, policy.String())
+		switch err := h.cancel(&v, &c); err {
+		case nil, service.ErrAlreadyCanceled:
+		case service.ErrNotEnoughBalance:
+			log.Println("Cancel not accepted. balance cant be negative.")
+		default:
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// accepted cancel not saved to database yet
+type pendingCancel struct {
+	data   models.Data
+	cancel models.Cancellation
+}
+
+// reverse record by cancel amount. used by post processing and manual cancel
+// returns ErrNotEnoughBalance if denied, ErrAlreadyCanceled if record canceled before
+func (h *Server) cancel(v *models.Data, c *models.Cancellation) error {
+
+	// negative balance rule of source type used for cancel too
+	if t, ok := h.SourceTypes.Get(v.Source); ok {
+		v.AllowNegative = t.Rules.AllowNegative
+	}
+
+	if h.Durable {
+		return h.cancelDurable(v, c)
+	}
+
+	return h.cancelBuffered(v, c)
+}
+
+// durable mode cancel. record status, user balance and cancellation changed in one database transaction
+// denied cancel saved with cancel denied status
+func (h *Server) cancelDurable(v *models.Data, c *models.Cancellation) error {
+
+	b, err := h.Repo.ApplyCancel(v, c)
+	if err != nil {
+		return err
+	}
+
+	h.Mu.Lock()
+	h.UserBalances[v.UserId] = models.Balance{Amount: b}
+	h.Mu.Unlock()
+
+	return nil
+}
+
+// buffered mode cancel. balance checked and changed in memory, written to log and then saved to database
+// accepted cancel saved to database again until success. never applied twice
+// status and balance not changed in one database transaction. users.balance saved later by balance update,
+// write-ahead log keeps both until saved
+func (h *Server) cancelBuffered(v *models.Data, c *models.Cancellation) error {
+
+	h.Mu.Lock()
+
+	// accepted before. saved with saveCancels or already saved
+	// record of second cancel can be read before status changed in database
+	if _, ok := h.cancelPending[v.ID]; ok || h.canceled[v.ID] {
+		h.Mu.Unlock()
+		return service.ErrAlreadyCanceled
+	}
+
+	b := h.UserBalances[v.UserId]
+	balance := b.Amount - c.Delta(*v)
+	if balance < 0 && balance < b.Amount && !v.AllowNegative {
+		h.Mu.Unlock()
+
+		// balance not changed. not saved denial decided again with next post processing
+		c.Deny(b.Amount)
+		if err := h.Repo.DenyCancel(v, c); err != nil && err != service.ErrAlreadyCanceled {
+			log.Println(err)
+		}
+		return service.ErrNotEnoughBalance
+	}
+
+	// cancel written to log before balance change. saved to database on replay if not saved before
+	c.Apply(*v, b.Amount)
+	if err := h.writeWAL(service.WALCancel, v, &balance, c); err != nil {
+		h.Mu.Unlock()
+		return err
+	}
+
+	if h.cancelPending == nil {
+		h.cancelPending = make(map[uint]pendingCancel)
+	}
+	h.cancelPending[v.ID] = pendingCancel{data: *v, cancel: *c}
+
+	b.Amount = balance
+	b.Saved = true
+	h.UserBalances[v.UserId] = b
+	h.Balance = true
+	h.Mu.Unlock()
+
+	// balance changed in memory. cancel saved even if log sync failed, request fails
+	syncErr := h.syncWAL(v.WalSeq)
+
+	// accepted. not saved cancel saved again with next post processing or shutdown
+	if err := h.saveCancel(pendingCancel{data: *v, cancel: *c}); err != nil {
+		log.Println(err)
+	}
+
+	return syncErr
+}
+
+// save accepted cancel to database. status changes only if record still processed
+// users.balance not changed. cache balance with cancel saved by balance update
+func (h *Server) saveCancel(p pendingCancel) error {
+
+	// transaction status canceled - 3
+	err := h.Repo.CancelTransaction(&p.data, &p.cancel)
+	if err != nil && err != service.ErrAlreadyCanceled {
+		return err
+	}
+
+	// status canceled in database. pending entry replaced by marker, not removed
+	h.Mu.Lock()
+	delete(h.cancelPending, p.data.ID)
+	if h.canceled == nil {
+		h.canceled = make(map[uint]bool)
+	}
+	h.canceled[p.data.ID] = true
+	h.Mu.Unlock()
+
+	return nil
+}
+
+// save cancels not saved to database before
+func (h *Server) saveCancels() error {
+
+	h.Mu.Lock()
+	pending := make([]pendingCancel, 0, len(h.cancelPending))
+	for _, v := range h.cancelPending {
+		pending = append(pending, v)
+	}
+	h.Mu.Unlock()
+
+	for _, v := range pending {
+		if err := h.saveCancel(v); err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
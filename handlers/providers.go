@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/labstack/echo"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// api key of provider for /api/processing
+	HeaderApiKey = "X-Api-Key"
+
+	// echo context key of authenticated provider
+	ContextProvider = "provider"
+)
+
+// authenticate provider with api key or provider token. provider must be allowed to send Source-Type of request
+// rejected requests doesnt use transaction id
+func (h *Server) ProviderAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return h.Auth(RoleProvider)(func(c echo.Context) error {
+
+		p, ok := c.Get(ContextProvider).(models.Provider)
+		if !ok {
+			return echo.NewHTTPError(http.StatusUnauthorized, &models.Response{Error: true, Message: "provider not authenticated"})
+		}
+
+		if !p.AllowsSource(c.Request().Header.Get("Source-Type")) {
+			return echo.NewHTTPError(http.StatusForbidden, &models.Response{Error: true, Message: "source type not allowed for provider"})
+		}
+
+		return next(c)
+	})
+}
+
+// @Summary Create provider
+// @Security BearerAuth
+// @Tags providers
+// @Description create provider with allowed source types. api key returned only once
+// @Accept json
+// @Produce json
+// @Param input body models.ProviderData true "provider info"
+// @Success 201 {object} models.Response
+// @Failure 400,401 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/providers [post]
+func (h *Server) CreateProvider(c echo.Context) error {
+
+	pd := new(models.ProviderData)
+	if err := c.Bind(pd); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "bad request"})
+	}
+
+	if pd.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "provider name cant be null"})
+	}
+
+	sourceTypes, err := h.providerSources(pd.SourceTypes)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	p := models.Provider{Name: pd.Name, SourceTypes: sourceTypes}
+	key, err := p.Rotate()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	var secret string
+	if pd.Signed {
+		secret, err = p.NewSecret()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+		}
+	}
+
+	if err := h.Repo.CreateProvider(&p); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	h.Mu.Lock()
+	h.setProvider("", p)
+	h.Mu.Unlock()
+
+	return c.JSON(http.StatusCreated, &models.Response{Message: "provider created", Data: models.ProviderKey{Provider: p, ApiKey: key, HmacSecret: secret}})
+}
+
+// @Summary Providers
+// @Security BearerAuth
+// @Tags providers
+// @Description all providers without api keys
+// @Produce json
+// @Success 200 {object} models.Response
+// @Failure 401 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/providers [get]
+func (h *Server) FetchProviders(c echo.Context) error {
+
+	providers, err := h.Repo.FetchProviders()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "providers", Data: providers})
+}
+
+// @Summary Rotate provider api key
+// @Security BearerAuth
+// @Tags providers
+// @Description new api key for provider. old api key stops working immediately. revoked provider activated again
+// @Produce json
+// @Param id path integer true "provider id"
+// @Success 200 {object} models.Response
+// @Failure 400,401,404 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/providers/{id}/rotate [post]
+func (h *Server) RotateProvider(c echo.Context) error {
+
+	p, err := h.findProvider(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	old := p.KeyHash
+	key, err := p.Rotate()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	if err := h.Repo.SaveProvider(&p); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	h.Mu.Lock()
+	h.setProvider(old, p)
+	h.Mu.Unlock()
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "api key rotated", Data: models.ProviderKey{Provider: p, ApiKey: key}})
+}
+
+// @Summary Revoke provider api key
+// @Security BearerAuth
+// @Tags providers
+// @Description api key of provider stops working. can be activated again with rotate
+// @Produce json
+// @Param id path integer true "provider id"
+// @Success 200 {object} models.Response
+// @Failure 400,401,404 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/providers/{id} [delete]
+func (h *Server) RevokeProvider(c echo.Context) error {
+
+	p, err := h.findProvider(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	if !p.Revoked() {
+		now := time.Now()
+		p.RevokedAt = &now
+
+		if err := h.Repo.SaveProvider(&p); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+		}
+	}
+
+	h.Mu.Lock()
+	h.setProvider(p.KeyHash, p)
+	h.Mu.Unlock()
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "api key revoked", Data: p})
+}
+
+// @Summary New provider hmac secret
+// @Security BearerAuth
+// @Tags providers
+// @Description new hmac secret for request signing. requests of provider must be signed with new secret immediately
+// @Produce json
+// @Param id path integer true "provider id"
+// @Success 200 {object} models.Response
+// @Failure 400,401,404 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/providers/{id}/secret [post]
+func (h *Server) RotateProviderSecret(c echo.Context) error {
+
+	p, err := h.findProvider(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	secret, err := p.NewSecret()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	if err := h.Repo.SaveProvider(&p); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	h.Mu.Lock()
+	h.setProvider(p.KeyHash, p)
+	h.Mu.Unlock()
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "hmac secret rotated", Data: models.ProviderKey{Provider: p, HmacSecret: secret}})
+}
+
+// @Summary Remove provider hmac secret
+// @Security BearerAuth
+// @Tags providers
+// @Description requests of provider not signed anymore
+// @Produce json
+// @Param id path integer true "provider id"
+// @Success 200 {object} models.Response
+// @Failure 400,401,404 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/providers/{id}/secret [delete]
+func (h *Server) RemoveProviderSecret(c echo.Context) error {
+
+	p, err := h.findProvider(c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	p.RemoveSecret()
+	if err := h.Repo.SaveProvider(&p); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	h.Mu.Lock()
+	h.setProvider(p.KeyHash, p)
+	h.Mu.Unlock()
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "hmac secret removed", Data: p})
+}
+
+// provider by api key hash
+func (h *Server) provider(hash string) (models.Provider, bool) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	p, ok := h.Providers[hash]
+	return p, ok
+}
+
+// cached provider by id. id from subject of provider token
+func (h *Server) providerById(id string) (models.Provider, bool) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	for _, v := range h.Providers {
+		if fmt.Sprint(v.ID) == id {
+			return v, true
+		}
+	}
+
+	return models.Provider{}, false
+}
+
+// provider by id from path parameter. returns echo error
+func (h *Server) findProvider(param string) (models.Provider, error) {
+
+	id, err := strconv.ParseUint(param, 10, 64)
+	if err != nil {
+		return models.Provider{}, echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "wrong provider id"})
+	}
+
+	providers, err := h.Repo.FetchProviders()
+	if err != nil {
+		return models.Provider{}, echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	for _, v := range providers {
+		if v.ID == uint(id) {
+			return v, nil
+		}
+	}
+
+	return models.Provider{}, echo.NewHTTPError(http.StatusNotFound, &models.Response{Error: true, Message: "provider not found"})
+}
+
+// replace cached provider. old --> previous api key hash. must be called with lock
+func (h *Server) setProvider(old string, p models.Provider) {
+	if h.Providers == nil {
+		h.Providers = make(map[string]models.Provider)
+	}
+
+	delete(h.Providers, old)
+	h.Providers[p.KeyHash] = p
+}
+
+// validate source type names. returns comma separated names
+func (h *Server) providerSources(names []string) (string, error) {
+
+	if len(names) == 0 {
+		return "", fmt.Errorf("provider must have at least one source type")
+	}
+
+	for _, v := range names {
+		if _, ok := h.SourceTypes.Find(v); !ok {
+			return "", fmt.Errorf("%s: not acceptable source type", v)
+		}
+	}
+
+	return strings.Join(names, ","), nil
+}
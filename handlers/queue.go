@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"github.com/SaCavid/simple-task/models"
+	"sync"
+)
+
+// TransactionQueue holds buffered transactions until bulk insert. safe for concurrent use. zero value is empty queue
+// transactions pushed in wal order. inserter takes batch from front and owns it until Done:
+// inserted --> batch removed, failed --> batch returned to front in same order, partly written --> Release
+// transaction never lost or inserted twice
+// taken batch still seen by Len, Find and Each. it is not in database yet
+type TransactionQueue struct {
+	mu    sync.Mutex
+	items []models.Data // waiting. oldest first
+	taken []models.Data // batch owned by inserter. older than items
+}
+
+// returns count of waiting transactions
+func (q *TransactionQueue) Push(d models.Data) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = append(q.items, d)
+	return len(q.items)
+}
+
+// oldest max transactions. nil --> queue empty or batch taken and not done yet
+func (q *TransactionQueue) Take(max int) []models.Data {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.taken != nil || len(q.items) == 0 {
+		return nil
+	}
+
+	n := len(q.items)
+	if n > max {
+		n = max
+	}
+
+	// capacity limited. transactions pushed later never written to taken batch
+	q.taken = q.items[:n:n]
+	q.items = q.items[n:]
+	return q.taken
+}
+
+// result of taken batch
+func (q *TransactionQueue) Done(inserted bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if inserted {
+		q.release(len(q.taken))
+		return
+	}
+	q.release(0)
+}
+
+// first n transactions of taken batch inserted or dropped. rest returned to front in same order
+func (q *TransactionQueue) Release(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.release(n)
+}
+
+func (q *TransactionQueue) release(n int) {
+	q.items = append(q.taken[n:], q.items...)
+	q.taken = nil
+}
+
+// transactions not inserted to database. taken batch included
+func (q *TransactionQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.taken) + len(q.items)
+}
+
+// latest transaction with id
+func (q *TransactionQueue) Find(transactionId string) (models.Data, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for k := len(q.items) - 1; k >= 0; k-- {
+		if q.items[k].TransactionId == transactionId {
+			return q.items[k], true
+		}
+	}
+
+	for k := len(q.taken) - 1; k >= 0; k-- {
+		if q.taken[k].TransactionId == transactionId {
+			return q.taken[k], true
+		}
+	}
+
+	return models.Data{}, false
+}
+
+// oldest not inserted transaction
+func (q *TransactionQueue) Oldest() (models.Data, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.taken) > 0 {
+		return q.taken[0], true
+	}
+
+	if len(q.items) > 0 {
+		return q.items[0], true
+	}
+
+	return models.Data{}, false
+}
+
+// every not inserted transaction oldest first. queue locked while f called, f must not use queue
+func (q *TransactionQueue) Each(f func(d models.Data)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, v := range q.taken {
+		f(v)
+	}
+
+	for _, v := range q.items {
+		f(v)
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"sync"
+	"testing"
+)
+
+// not inserted transactions oldest first
+func queued(q *TransactionQueue) []models.Data {
+	list := make([]models.Data, 0)
+	q.Each(func(d models.Data) {
+		list = append(list, d)
+	})
+
+	return list
+}
+
+func TestTransactionQueue_Order(t *testing.T) {
+	var q TransactionQueue
+
+	for i := 1; i <= 5; i++ {
+		q.Push(models.Data{TransactionId: fmt.Sprint(i)})
+	}
+
+	batch := q.Take(3)
+	if len(batch) != 3 || batch[0].TransactionId != "1" {
+		t.Fatalf("unexpected batch %+v", batch)
+	}
+
+	// one batch owned by inserter at same time
+	if q.Take(3) != nil {
+		t.Fatal("expected no batch while batch taken")
+	}
+
+	// pushed while batch taken. taken batch not changed
+	q.Push(models.Data{TransactionId: "6"})
+	if batch[2].TransactionId != "3" {
+		t.Fatalf("taken batch changed %+v", batch)
+	}
+
+	if d, ok := q.Find("2"); !ok || d.TransactionId != "2" || q.Len() != 6 {
+		t.Fatal("taken batch must be seen until done")
+	}
+
+	// failed batch returned to front
+	q.Done(false)
+
+	ids := ""
+	for _, v := range queued(&q) {
+		ids += v.TransactionId
+	}
+
+	if ids != "123456" {
+		t.Fatalf("expected same order after failed insert, got %s", ids)
+	}
+
+	q.Take(4)
+	q.Done(true)
+
+	if d, ok := q.Oldest(); !ok || d.TransactionId != "5" || q.Len() != 2 {
+		t.Fatalf("expected 5 and 6 left, got %+v", queued(&q))
+	}
+
+	// partly written batch. rest returned to front
+	q.Take(2)
+	q.Release(1)
+
+	if d, ok := q.Oldest(); !ok || d.TransactionId != "6" || q.Len() != 1 {
+		t.Fatalf("expected 6 left, got %+v", queued(&q))
+	}
+}
+
+// concurrent producers and failing inserter. every transaction inserted once in push order of producer
+func TestTransactionQueue_Concurrent(t *testing.T) {
+	var q TransactionQueue
+
+	const producers, count = 8, 2000
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				q.Push(models.Data{UserId: fmt.Sprint(p), Amount: models.Money(i)})
+			}
+		}(p)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	inserted := make([]models.Data, 0, producers*count)
+	for attempt := 0; ; attempt++ {
+		batch := q.Take(100)
+		if batch == nil {
+			if finished(done) && q.Len() == 0 {
+				break
+			}
+			continue
+		}
+
+		// every third insert fails
+		if attempt%3 == 0 {
+			q.Done(false)
+			continue
+		}
+
+		inserted = append(inserted, batch...)
+		q.Done(true)
+	}
+
+	if len(inserted) != producers*count {
+		t.Fatalf("expected %d inserted, got %d", producers*count, len(inserted))
+	}
+
+	next := make(map[string]models.Money)
+	for _, v := range inserted {
+		if v.Amount != next[v.UserId] {
+			t.Fatalf("producer %s: expected %d, got %d. transaction lost or duplicated", v.UserId, next[v.UserId], v.Amount)
+		}
+		next[v.UserId]++
+	}
+}
+
+func finished(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/SaCavid/simple-task/service"
+	"github.com/labstack/echo"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// compare users.balance and in-memory balances with balance recomputed from transaction records
+// repair --> database and cache balance of users without pending changes set to recomputed balance
+func (h *Server) Reconcile(repair bool) (models.ReconcileReport, error) {
+
+	// records saved while recomputing were pending before. records accepted while recomputing are pending after
+	h.Mu.Lock()
+	pending := h.pendingUsers()
+	h.Mu.Unlock()
+
+	checks, err := h.Repo.ReconcileBalances()
+	if err != nil {
+		return models.ReconcileReport{}, err
+	}
+
+	report := models.ReconcileReport{Time: time.Now(), Users: len(checks), Repair: repair, Discrepancies: make([]models.Discrepancy, 0)}
+
+	h.Mu.Lock()
+	for id := range h.pendingUsers() {
+		pending[id] = true
+	}
+
+	for _, v := range checks {
+		d := models.Discrepancy{UserId: v.UserId, Expected: v.Expected, Database: v.Balance, Pending: pending[v.UserId]}
+		if b, ok := h.UserBalances[v.UserId]; ok {
+			d.Cache = &b.Amount
+		}
+
+		if d.Database == d.Expected && (d.Cache == nil || *d.Cache == d.Expected) {
+			continue
+		}
+
+		report.Discrepancies = append(report.Discrepancies, d)
+	}
+	h.Mu.Unlock()
+
+	if !repair {
+		return report, nil
+	}
+
+	for k := range report.Discrepancies {
+		d := &report.Discrepancies[k]
+		if d.Pending {
+			continue
+		}
+
+		if err := h.repair(d); err != nil {
+			log.Println("Reconciliation repair of user", d.UserId+":", err)
+		}
+	}
+
+	return report, nil
+}
+
+// users with buffered transactions, not saved cancels or not saved cache balance. must be called with lock
+func (h *Server) pendingUsers() map[string]bool {
+
+	pending := h.unpostedUsers()
+	for id, b := range h.UserBalances {
+		if b.Saved {
+			pending[id] = true
+		}
+	}
+
+	return pending
+}
+
+// users with buffered transactions or not saved cancels. postings of user not in ledger yet. must be called with lock
+func (h *Server) unpostedUsers() map[string]bool {
+
+	unposted := make(map[string]bool)
+	h.Transactions.Each(func(v models.Data) {
+		unposted[v.UserId] = true
+	})
+
+	for _, v := range h.cancelPending {
+		unposted[v.data.UserId] = true
+	}
+
+	return unposted
+}
+
+// balances changed after check not repaired. ErrBalanceChanged returned
+func (h *Server) repair(d *models.Discrepancy) error {
+	if h.Durable {
+		return h.repairDurable(d)
+	}
+
+	return h.repairBuffered(d)
+}
+
+// cache is copy of users.balance. database repaired first
+func (h *Server) repairDurable(d *models.Discrepancy) error {
+
+	if d.Database != d.Expected {
+		if err := h.Repo.RepairBalance(d.UserId, d.Database, d.Expected); err != nil {
+			return err
+		}
+	}
+
+	if d.Cache != nil && *d.Cache != d.Expected {
+		// transaction committed after check can be in database already
+		user, err := h.Repo.FindUser(d.UserId)
+		if err != nil {
+			return err
+		}
+		balance := user.Balance
+
+		h.Mu.Lock()
+		b, ok := h.UserBalances[d.UserId]
+		if !ok || b.Amount != *d.Cache || b.Saved {
+			h.Mu.Unlock()
+			return service.ErrBalanceChanged
+		}
+
+		b.Amount = balance
+		h.UserBalances[d.UserId] = b
+		h.Mu.Unlock()
+	}
+
+	d.Repaired = true
+	return nil
+}
+
+// in-memory balance is ahead of database. checked, written to log and database repaired with lock
+// handlers wait for repair of one user. database never repaired for changed cache
+func (h *Server) repairBuffered(d *models.Discrepancy) error {
+
+	h.Mu.Lock()
+	b, ok := h.UserBalances[d.UserId]
+	if (d.Cache != nil) != ok || (ok && (b.Amount != *d.Cache || b.Saved)) || h.unpostedUsers()[d.UserId] {
+		h.Mu.Unlock()
+		return service.ErrBalanceChanged
+	}
+
+	// user not in cache. nothing to log
+	if !ok {
+		h.Mu.Unlock()
+		if err := h.Repo.RepairBalance(d.UserId, d.Database, d.Expected); err != nil {
+			return err
+		}
+
+		d.Repaired = true
+		return nil
+	}
+
+	// logged before database. replay restores repaired balance, failed repair logged back
+	data := models.Data{UserId: d.UserId}
+	balance := d.Expected
+	if err := h.writeWAL(service.WALBalance, &data, &balance, nil); err != nil {
+		h.Mu.Unlock()
+		return err
+	}
+
+	if d.Database != d.Expected {
+		if err := h.Repo.RepairBalance(d.UserId, d.Database, d.Expected); err != nil {
+			if werr := h.writeWAL(service.WALBalance, &data, &b.Amount, nil); werr != nil {
+				log.Println(werr)
+			}
+			h.Mu.Unlock()
+
+			if werr := h.syncWAL(data.WalSeq); werr != nil {
+				log.Println(werr)
+			}
+			return err
+		}
+	}
+
+	b.Amount = balance
+	h.UserBalances[d.UserId] = b
+	h.Mu.Unlock()
+
+	d.Repaired = true
+	return h.syncWAL(data.WalSeq)
+}
+
+// periodic reconciliation. report logged and saved to ReconcileDir
+// stops when ctx canceled
+func (h *Server) Reconciliation(ctx context.Context) {
+
+	for sleep(ctx, h.ReconcileInterval) {
+		report, err := h.Reconcile(h.ReconcileRepair)
+		if err != nil {
+			log.Println("Reconciliation:", err)
+			continue
+		}
+
+		for _, d := range report.Discrepancies {
+			if !d.Pending {
+				log.Printf("Reconciliation: user %s expected %s database %s repaired %v", d.UserId, d.Expected, d.Database, d.Repaired)
+			}
+		}
+		log.Printf("Reconciliation: %d users checked, %d discrepancies", report.Users, len(report.Discrepancies))
+
+		if h.ReconcileDir == "" {
+			continue
+		}
+
+		if err := SaveReport(h.ReconcileDir, report); err != nil {
+			log.Println("Reconciliation:", err)
+		}
+	}
+}
+
+// report saved as reconcile-<time>.json and reconcile-<time>.csv
+func SaveReport(dir string, report models.ReconcileReport) error {
+
+	name := filepath.Join(dir, "reconcile-"+report.Time.UTC().Format("20060102T150405Z"))
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(name+".json", b, 0644); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteCSV(&buf); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(name+".csv", buf.Bytes(), 0644)
+}
+
+// @Summary Reconciliation report
+// @Security BearerAuth
+// @Tags reconciliation
+// @Description users with users.balance or in-memory balance different from balance recomputed from transaction records
+// @Produce json
+// @Produce text/csv
+// @Param format query string false "json / csv. default json"
+// @Success 200 {object} models.Response
+// @Failure 400,401,403 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/reconciliation [get]
+func (h *Server) ReconciliationReport(c echo.Context) error {
+	return h.reconcile(c, false)
+}
+
+// @Summary Repair balances
+// @Security BearerAuth
+// @Tags reconciliation
+// @Description database and in-memory balance set to balance recomputed from transaction records.
+// @Description users with pending transactions, cancels or not saved balance not repaired
+// @Produce json
+// @Produce text/csv
+// @Param format query string false "json / csv. default json"
+// @Success 200 {object} models.Response
+// @Failure 400,401,403 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/reconciliation [post]
+func (h *Server) RepairBalances(c echo.Context) error {
+	return h.reconcile(c, true)
+}
+
+func (h *Server) reconcile(c echo.Context, repair bool) error {
+
+	format := c.QueryParam("format")
+	if format != "" && format != "json" && format != "csv" {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "format must be json or csv"})
+	}
+
+	report, err := h.Reconcile(repair)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	if format == "csv" {
+		var buf bytes.Buffer
+		if err := report.WriteCSV(&buf); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+		}
+
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=reconcile-%s.csv", report.Time.UTC().Format("20060102T150405Z")))
+		return c.Blob(http.StatusOK, "text/csv", buf.Bytes())
+	}
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "reconciliation", Data: report})
+}
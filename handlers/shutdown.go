@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"context"
+	"time"
+)
+
+// sleep d or until ctx canceled. returns false if canceled
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// save all not saved transactions and balances to database
+// used on shutdown after background workers stopped and http server stopped accepting requests
+func (h *Server) Flush() error {
+
+	if err := h.flushBuffered(); err != nil {
+		return err
+	}
+
+	// accepted cancels saved before balances. saved balance includes cancel, record status changed first
+	if err := h.saveCancels(); err != nil {
+		return err
+	}
+
+	if err := h.flushBalances(); err != nil {
+		return err
+	}
+
+	h.compactWAL()
+	return nil
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/labstack/echo"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// hex encoded HMAC-SHA256 of timestamp + "." + request body. key --> hmac secret of provider
+	HeaderSignature = "X-Signature"
+
+	// unix time in seconds when request signed
+	HeaderTimestamp = "X-Timestamp"
+
+	// default allowed difference between signature timestamp and server time
+	SignatureWindow = 5 * time.Minute
+
+	// maximum size of signed request body
+	maxSignedBody = 1 << 20
+)
+
+// check HMAC signature of request body for providers with hmac secret. must be used after ProviderAuth
+// providers without hmac secret not checked
+// old signatures rejected. repeated request inside window gets idempotent replay of transaction id
+func (h *Server) SignatureAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		p, ok := c.Get(ContextProvider).(models.Provider)
+		if !ok {
+			return echo.NewHTTPError(http.StatusUnauthorized, &models.Response{Error: true, Message: "provider not authenticated"})
+		}
+
+		if p.HmacSecret == "" {
+			return next(c)
+		}
+
+		ts := c.Request().Header.Get(HeaderTimestamp)
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, &models.Response{Error: true, Message: "wrong signature timestamp"})
+		}
+
+		window := h.SignatureWindow
+		if window <= 0 {
+			window = SignatureWindow
+		}
+
+		if d := time.Since(time.Unix(sec, 0)); d > window || d < -window {
+			return echo.NewHTTPError(http.StatusUnauthorized, &models.Response{Error: true, Message: "signature expired"})
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxSignedBody+1))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "bad request"})
+		}
+
+		if len(body) > maxSignedBody {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, &models.Response{Error: true, Message: "request body too large"})
+		}
+
+		// constant time comparison. doesnt leak how many characters of signature are correct
+		expected := models.Signature(p.HmacSecret, ts, body)
+		if !hmac.Equal([]byte(c.Request().Header.Get(HeaderSignature)), []byte(expected)) {
+			return echo.NewHTTPError(http.StatusUnauthorized, &models.Response{Error: true, Message: "wrong signature"})
+		}
+
+		// body read for signature. handler must read same body again
+		c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		return next(c)
+	}
+}
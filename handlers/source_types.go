@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"github.com/SaCavid/simple-task/models"
+	"github.com/labstack/echo"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// @Summary Source types
+// @Security BearerAuth
+// @Tags source types
+// @Description all source types with disabled ones
+// @Produce json
+// @Success 200 {object} models.Response
+// @Failure 401,403 {object} models.Response
+// @Router /api/source-types [get]
+func (h *Server) FetchSourceTypes(c echo.Context) error {
+	return c.JSON(http.StatusOK, &models.Response{Message: "source types", Data: h.SourceTypes.List()})
+}
+
+// @Summary Create source type
+// @Security BearerAuth
+// @Tags source types
+// @Description new source type. id assigned once and never reused
+// @Accept json
+// @Produce json
+// @Param input body models.SourceTypeData true "source type info"
+// @Success 201 {object} models.Response
+// @Failure 400,401,403 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/source-types [post]
+func (h *Server) CreateSourceType(c echo.Context) error {
+
+	sd := new(models.SourceTypeData)
+	if err := c.Bind(sd); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "bad request"})
+	}
+
+	// names of provider source types saved comma separated
+	if sd.Name == "" || strings.ContainsAny(sd.Name, ", ") {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "source type name cant be null or contain comma and space"})
+	}
+
+	if _, ok := h.SourceTypes.Find(sd.Name); ok {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "source type already exists"})
+	}
+
+	t := models.SourceType{Name: sd.Name, Enabled: sd.Enabled == nil || *sd.Enabled}
+	if sd.Rules != nil {
+		if err := sd.Rules.Validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: err.Error()})
+		}
+		t.Rules = *sd.Rules
+	}
+
+	if err := h.Repo.CreateSourceType(&t); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	h.SourceTypes.Set(t)
+
+	return c.JSON(http.StatusCreated, &models.Response{Message: "source type created", Data: t})
+}
+
+// @Summary Update source type
+// @Security BearerAuth
+// @Tags source types
+// @Description enable, disable or change rules. disabled source type not accepted for new transactions. name can't be changed
+// @Accept json
+// @Produce json
+// @Param id path integer true "source type id"
+// @Param input body models.SourceTypeData true "enabled and rules"
+// @Success 200 {object} models.Response
+// @Failure 400,401,403,404 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/source-types/{id} [put]
+func (h *Server) UpdateSourceType(c echo.Context) error {
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "wrong source type id"})
+	}
+
+	sd := new(models.SourceTypeData)
+	if err := c.Bind(sd); err != nil || (sd.Enabled == nil && sd.Rules == nil) {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "bad request"})
+	}
+
+	t, ok := h.SourceTypes.Get(id)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, &models.Response{Error: true, Message: "source type not found"})
+	}
+
+	if sd.Enabled != nil {
+		t.Enabled = *sd.Enabled
+	}
+
+	// rules replaced completely
+	if sd.Rules != nil {
+		if err := sd.Rules.Validate(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: err.Error()})
+		}
+		t.Rules = *sd.Rules
+	}
+
+	if err := h.Repo.SaveSourceType(&t); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+	}
+
+	h.SourceTypes.Set(t)
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "source type updated", Data: t})
+}
@@ -1,35 +1,124 @@
 package handlers
 
-import "fmt"
+import (
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"sort"
+	"sync"
+)
 
-type SourceType int
+// registry of source types for requests
+// loaded from database at startup and changed with admin api. new source types doesnt need rebuild
+type SourceTypes struct {
+	mu    sync.RWMutex
+	types map[int]models.SourceType
+}
 
-// const for source type of requests
-const (
-	game SourceType = iota
-	server
-	payment
-)
+func NewSourceTypes(types []models.SourceType) *SourceTypes {
+	s := &SourceTypes{}
+	s.Load(types)
 
-var (
-	// must be unique names
-	// index must be same as in constants
-	SourceTypes = [...]string{"game", "server", "payment"}
-)
+	return s
+}
+
+// replace all source types
+func (s *SourceTypes) Load(types []models.SourceType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.types = make(map[int]models.SourceType, len(types))
+	for _, v := range types {
+		s.types[v.ID] = v
+	}
+}
+
+// add or replace source type
+func (s *SourceTypes) Set(t models.SourceType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-// get source type as string
-func (s SourceType) String() string {
-	return SourceTypes[s]
+	s.types[t.ID] = t
 }
 
-// get index of source type
-func (s SourceType) IndexOf(name string) (int, error) {
+// get source type by id. disabled source types included
+func (s *SourceTypes) Get(id int) (models.SourceType, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	for k, v := range SourceTypes {
-		if v == name {
-			return k, nil
+	t, ok := s.types[id]
+	return t, ok
+}
+
+// get source type name. disabled source types included
+func (s *SourceTypes) String(id int) string {
+	if t, ok := s.Get(id); ok {
+		return t.Name
+	}
+
+	return "unknown"
+}
+
+// get source type by name. disabled source types included
+func (s *SourceTypes) Find(name string) (models.SourceType, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, v := range s.types {
+		if v.Name == name {
+			return v, true
 		}
 	}
 
-	return -1, fmt.Errorf("not acceptable source type")
+	return models.SourceType{}, false
+}
+
+// get enabled source type with rules. used for new transactions
+func (s *SourceTypes) Accept(name string) (models.SourceType, error) {
+
+	t, ok := s.Find(name)
+	if !ok {
+		return models.SourceType{ID: -1}, fmt.Errorf("not acceptable source type")
+	}
+
+	if !t.Enabled {
+		return models.SourceType{ID: -1}, fmt.Errorf("source type disabled")
+	}
+
+	return t, nil
+}
+
+// get id of enabled source type
+func (s *SourceTypes) IndexOf(name string) (int, error) {
+	t, err := s.Accept(name)
+	return t.ID, err
+}
+
+// ids of source types never canceled by post processing
+func (s *SourceTypes) NotCancelable() []int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]int, 0)
+	for _, v := range s.types {
+		if v.Rules.NotCancelable {
+			ids = append(ids, v.ID)
+		}
+	}
+
+	sort.Ints(ids)
+	return ids
+}
+
+// all source types ordered by id
+func (s *SourceTypes) List() []models.SourceType {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	types := make([]models.SourceType, 0, len(s.types))
+	for _, v := range s.types {
+		types = append(types, v)
+	}
+
+	sort.Slice(types, func(i, j int) bool { return types[i].ID < types[j].ID })
+	return types
 }
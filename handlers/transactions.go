@@ -1,13 +1,21 @@
 package handlers
 
 import (
-	"fmt"
+	"context"
 	"github.com/SaCavid/simple-task/models"
+	"github.com/SaCavid/simple-task/service"
+	"github.com/labstack/echo"
 	"log"
-	"strings"
+	"net/http"
 	"time"
 )
 
+// buffered transactions inserted when batch is full or delay passed
+const (
+	InsertBatch = 5000
+	InsertDelay = 200 * time.Millisecond
+)
+
 // check transaction id to map
 func (h *Server) CheckTransactionId(id string) bool {
 	h.Mu.Lock()
@@ -16,80 +24,375 @@ func (h *Server) CheckTransactionId(id string) bool {
 	return ok
 }
 
-// save transaction id to map
-func (h *Server) SaveTransactionId(id string) {
+// reserve transaction id before processing. one check for concurrent requests with same id
+// returns saved outcome and true if transaction id already used
+func (h *Server) ReserveTransactionId(id, hash string) (models.Outcome, bool) {
 	h.Mu.Lock()
-	h.TransactionIds[id] = ""
+	defer h.Mu.Unlock()
+
+	o, ok := h.TransactionIds[id]
+	if !ok {
+		h.TransactionIds[id] = models.Outcome{RequestHash: hash}
+	}
+
+	return o, ok
+}
+
+// save response of processed transaction id
+func (h *Server) SaveOutcome(id string, o models.Outcome) {
+	h.Mu.Lock()
+	h.TransactionIds[id] = o
 	h.Mu.Unlock()
 }
 
+// saved response of transaction record
+func outcomeOf(d models.Data) models.Outcome {
+	o := models.Outcome{
+		RequestHash: d.RequestHash,
+		Code:        d.Code,
+		Response:    models.Response{Error: d.Code >= http.StatusBadRequest, Message: d.Message},
+	}
+
+	if d.Code == http.StatusCreated {
+		o.Response.Data = "Balance:" + d.Balance.String()
+	}
+
+	return o
+}
+
 // save transaction record to temp map
+// durable mode saves record directly to database
 func (h *Server) SaveTransaction(data models.Data) {
+	if h.Durable {
+		if err := h.Repo.CreateData(&data); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
 	h.Mu.Lock()
-	h.Transactions = append(h.Transactions, data)
+	err := h.writeWAL(service.WALTransaction, &data, nil, nil)
+	if err == nil {
+		h.enqueue(data)
+	}
 	h.Mu.Unlock()
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err := h.syncWAL(data.WalSeq); err != nil {
+		log.Println(err)
+	}
 }
 
-// bulk insert transactions
-func (h *Server) BulkInsertTransactions() {
+// bulk insert transactions when InsertBatch transactions buffered or InsertDelay passed
+// database errors retried with exponential backoff
+// stops when ctx canceled. not inserted transactions must be saved with Flush
+func (h *Server) BulkInsertTransactions(ctx context.Context) {
 
-	for {
+	backoff := service.Backoff{Min: 100 * time.Millisecond, Max: 30 * time.Second}
+
+	h.Mu.Lock()
+	full := h.batchSignal()
+	delay := h.InsertDelay
+	h.Mu.Unlock()
+
+	if delay <= 0 {
+		delay = InsertDelay
+	}
 
-		h.Mu.Lock()
+	ticker := time.NewTicker(delay)
+	defer ticker.Stop()
 
-		if len(h.Transactions) <= 0 {
-			h.Mu.Unlock()
-			time.Sleep(10 * time.Second)
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-full:
+			err = h.flushFull()
+		case <-ticker.C:
+			err = h.flushBuffered()
+		}
+
+		if err != nil {
+			log.Println(err)
+			sleep(ctx, backoff.Next())
 			continue
 		}
-		count := len(h.Transactions)
 
-		// maximum 500 rows per operation for safe database usage
-		if count > 500 {
-			count = 500
+		backoff.Reset()
+		h.compactWAL()
+	}
+}
+
+// insert full batches. smaller rest waits for delay
+func (h *Server) flushFull() error {
+
+	for h.QueueDepth() >= h.batchSize() {
+		if _, err := h.flushTransactions(); err != nil {
+			return err
 		}
+	}
 
-		transactionsList := h.Transactions[:count]
-		h.Mu.Unlock()
+	return nil
+}
 
-		tx := h.Repo.Db.Begin()
-		err := tx.Error
-		if err != nil {
-			log.Println(err)
+// insert one batch of saved transactions to database
+// batch returned to queue if insert failed. returns count of transactions removed from queue, inserted or saved to dead letters
+func (h *Server) flushTransactions() (int, error) {
+
+	h.flushMu.Lock()
+	defer h.flushMu.Unlock()
+
+	h.Mu.Lock()
+	batch := h.insertBatch()
+	h.Mu.Unlock()
+
+	// large batches copied with COPY by postgres repository
+	transactionsList := h.Transactions.Take(batch)
+	if len(transactionsList) == 0 {
+		return 0, nil
+	}
+
+	inserted, dropped, err := h.writeTransactions(transactionsList)
+
+	// written part of batch removed. rest returned to front
+	h.Transactions.Release(inserted + dropped)
+
+	h.Mu.Lock()
+	if err != nil {
+		h.insertFailures++
+	}
+	h.inserted += uint64(inserted)
+	h.deadLettered += uint64(dropped)
+	h.Mu.Unlock()
+
+	return inserted + dropped, err
+}
+
+// batch with row error split in halves until bad row found. row which can never be inserted saved to dead letters
+// row with transaction id already in database counted as inserted. saved by attempt with lost commit result
+// returns counts of inserted and dropped transactions from front of batch. transactions after database error not written
+func (h *Server) writeTransactions(batch []models.Data) (int, int, error) {
+
+	err := h.Repo.InsertTransactions(batch)
+	if err == nil {
+		return len(batch), 0, nil
+	}
+
+	if !service.RowError(err) {
+		if h.committed(batch) {
+			return len(batch), 0, nil
+		}
+		return 0, 0, err
+	}
+
+	if len(batch) == 1 {
+		// saved by earlier attempt. commit result lost and lookup failed before
+		if service.DuplicateTransaction(err) {
+			_, ferr := h.Repo.FindTransaction(batch[0].TransactionId)
+			if ferr == nil {
+				return 1, 0, nil
+			}
+
+			if ferr != service.ErrNotFound {
+				return 0, 0, ferr
+			}
+		}
+
+		if err := h.deadLetterTransaction(batch[0], err); err != nil {
+			return 0, 0, err
+		}
+		return 0, 1, nil
+	}
+
+	half := len(batch) / 2
+	inserted, dropped, err := h.writeTransactions(batch[:half])
+	if err != nil {
+		return inserted, dropped, err
+	}
+
+	i, d, err := h.writeTransactions(batch[half:])
+	return inserted + i, dropped + d, err
+}
+
+// error after commit. connection lost before result of commit received
+// batch inserted in one database transaction. one saved record --> all saved
+func (h *Server) committed(batch []models.Data) bool {
+	for _, v := range batch {
+		if v.TransactionId == "" {
 			continue
 		}
 
-		var value []string
-		var values []interface{}
-		for _, data := range transactionsList {
-			value = append(value, "(?,?,?,?,?,?,?,?,?)")
-			values = append(values, data.CreatedAt)
-			values = append(values, data.UpdatedAt)
-			values = append(values, data.DeletedAt)
-			values = append(values, data.UserId)
-			values = append(values, data.State)
-			values = append(values, data.Status)
-			values = append(values, data.Source)
-			values = append(values, data.Amount)
-			values = append(values, data.TransactionId)
+		_, err := h.Repo.FindTransaction(v.TransactionId)
+		return err == nil
+	}
+
+	return false
+}
+
+// buffer transaction for bulk insert. bulk insert woken when batch is full. must be called with lock
+func (h *Server) enqueue(d models.Data) {
+	if h.Transactions.Push(d) >= h.insertBatch() {
+		h.batchFull()
+	}
+}
+
+// rows per bulk insert. must be called with lock
+func (h *Server) insertBatch() int {
+	if h.InsertBatch <= 0 {
+		return InsertBatch
+	}
+
+	return h.InsertBatch
+}
+
+// signal of full batch. must be called with lock
+func (h *Server) batchSignal() chan struct{} {
+	if h.full == nil {
+		h.full = make(chan struct{}, 1)
+	}
+
+	return h.full
+}
+
+// wake bulk insert. not blocked if already signaled. must be called with lock
+func (h *Server) batchFull() {
+	select {
+	case h.batchSignal() <- struct{}{}:
+	default:
+	}
+}
+
+// @Summary Insert queue
+// @Security BearerAuth
+// @Tags transactions
+// @Description buffered transactions waiting for bulk insert
+// @Produce json
+// @Success 200 {object} models.Response
+// @Failure 401,403 {object} models.Response
+// @Router /api/queue [get]
+func (h *Server) InsertQueue(c echo.Context) error {
+
+	h.Mu.Lock()
+	info := models.QueueInfo{
+		Depth:    h.Transactions.Len(),
+		Batch:    h.insertBatch(),
+		Inserted: h.inserted,
+		Failures: h.insertFailures,
+		Dropped:  h.deadLettered,
+	}
+	h.Mu.Unlock()
+
+	delay := h.InsertDelay
+	if delay <= 0 {
+		delay = InsertDelay
+	}
+	info.Delay = delay.String()
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "insert queue", Data: info})
+}
+
+// transactions buffered and not inserted to database yet
+func (h *Server) QueueDepth() int {
+	return h.Transactions.Len()
+}
+
+func (h *Server) batchSize() int {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	return h.insertBatch()
+}
+
+// insert transactions buffered before call. transactions buffered while inserting left for next bulk insert
+func (h *Server) flushBuffered() error {
+
+	remaining := h.Transactions.Len()
+
+	for remaining > 0 {
+		n, err := h.flushTransactions()
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			break
+		}
+		remaining -= n
+	}
+
+	return nil
+}
+
+// @Summary Transaction status
+// @Security ProviderKeyAuth
+// @Security BearerAuth
+// @Tags handler
+// @Description status of transaction. not saved transactions from memory buffer are included. cancellations of canceled records included. provider reads only own transactions
+// @Produce json
+// @Param transactionId path string true "transaction id"
+// @Success 200 {object} models.Response
+// @Failure 401,403,404 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/transactions/{transactionId} [get]
+func (h *Server) TransactionStatus(c echo.Context) error {
+
+	id := c.Param("transactionId")
+
+	data, pending := h.pendingTransaction(id)
+	if !pending {
+		var err error
+		data, err = h.Repo.FindTransaction(id)
+		if err == service.ErrNotFound {
+			return echo.NewHTTPError(http.StatusNotFound, &models.Response{Error: true, Message: "transaction not found"})
 		}
 
-		stmt := fmt.Sprintf("INSERT INTO data (created_at, updated_at, deleted_at, user_id, state, status, source, amount, transaction_id) VALUES %s", strings.Join(value, ","))
-		err = tx.Exec(stmt, values...).Error
 		if err != nil {
-			tx.Rollback()
-			log.Println(err)
+			return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+		}
+	}
+
+	// provider reads only own transactions. transaction of other provider not disclosed
+	if claims, ok := c.Get(ContextClaims).(*service.Claims); ok && claims.Role == RoleProvider {
+		provider, ok := c.Get(ContextProvider).(models.Provider)
+		if !ok || data.ProviderId != provider.ID {
+			return echo.NewHTTPError(http.StatusNotFound, &models.Response{Error: true, Message: "transaction not found"})
 		}
+	}
 
-		err = tx.Commit().Error
+	info := h.transactionInfo(data, pending)
+	if data.Status == models.StatusCanceled || data.Status == models.StatusCancelDenied {
+		cancellations, err := h.Repo.FetchCancellations(data.ID)
 		if err != nil {
-			log.Println(err)
-			continue
+			return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
 		}
+		info.Cancellations = cancellations
+	}
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "transaction", Data: info})
+}
 
-		// empty inserted transactions if not error
-		h.Transactions = h.Transactions[count:]
+// find transaction not inserted to database yet
+func (h *Server) pendingTransaction(id string) (models.Data, bool) {
+	return h.Transactions.Find(id)
+}
 
-		//	log.Println("Rows inserted:", len(values)/8)
+func (h *Server) transactionInfo(d models.Data, pending bool) models.TransactionInfo {
+	return models.TransactionInfo{
+		Id:            d.ID,
+		TransactionId: d.TransactionId,
+		UserId:        d.UserId,
+		State:         d.StateName(),
+		Status:        d.StatusName(),
+		Source:        h.SourceTypes.String(d.Source),
+		Amount:        d.Amount,
+		Balance:       d.Balance,
+		Pending:       pending,
+		CreatedAt:     d.CreatedAt,
+		UpdatedAt:     d.UpdatedAt,
 	}
 }
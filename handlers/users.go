@@ -1,12 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"github.com/SaCavid/simple-task/models"
+	"github.com/SaCavid/simple-task/service"
 	"github.com/labstack/echo"
 	"log"
 	"net/http"
-	"strings"
 	"time"
 )
 
@@ -24,19 +25,23 @@ func (h *Server) Register(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "user id can't be null"})
 	}
 
+	if !models.ValidId(user.UserId) {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "user id must be utf-8 without null character"})
+	}
+
 	// check if user already registered or not
 	if h.CheckUser(user.UserId) {
 		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "user already registered"})
 	}
 
 	// add user to database
-	err := h.Repo.Db.Create(user).Error
+	err := h.Repo.CreateUser(user)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
 	}
 
-	// add user to map for further use
-	h.AddUser(user.UserId)
+	// add user to map for further use. balance of registration posted to ledger as opening entry
+	h.AddUser(user.UserId, user.Balance)
 
 	return c.JSON(http.StatusOK, &models.Response{Message: "user registered"})
 }
@@ -47,75 +52,151 @@ func (h *Server) FetchUsersForTesting(c echo.Context) error {
 		UserId string
 	}
 
-	users := make([]User, 0)
-
-	err := h.Repo.Db.Table("users").Find(&users).Error
+	list, err := h.Repo.FetchUsers()
 	if err != nil {
 		log.Println(err)
 		return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
 	}
 
+	users := make([]User, 0, len(list))
+	for _, v := range list {
+		users = append(users, User{UserId: v.UserId})
+	}
+
 	return c.JSON(http.StatusOK, &models.Response{Message: "users", Data: users})
 }
 
 // update user balances if get true in Server.Balance
-func (h *Server) BulkUpdateBalances() {
+// database errors retried with exponential backoff
+// stops when ctx canceled. not saved balances must be saved with Flush
+func (h *Server) BulkUpdateBalances(ctx context.Context) {
 
-	for {
+	backoff := service.Backoff{Min: 100 * time.Millisecond, Max: 30 * time.Second}
 
-		if !h.Balance {
-			time.Sleep(1 * time.Second)
-			continue
+	for ctx.Err() == nil {
+
+		h.Mu.Lock()
+		saved := !h.Balance
+		if saved {
+			// nothing to save. all balances in log are in database
+			h.balancesSaved(h.walSeq())
 		}
+		h.Mu.Unlock()
 
-		type balance struct {
-			UserId string
-			Amount float64
+		if saved {
+			h.compactWAL()
+			sleep(ctx, 1*time.Second)
+			continue
 		}
 
-		balancesList := make([]balance, 0)
+		if err := h.flushBalances(); err != nil {
+			log.Println(err)
+			sleep(ctx, backoff.Next())
+			continue
+		}
+		backoff.Reset()
 
+		// balances waiting for bulk insert or cancel save. not checked again without delay
 		h.Mu.Lock()
-		for k, v := range h.UserBalances {
-			if v.Saved {
-				s := balance{
-					UserId: k,
-					Amount: v.Amount,
-				}
-				balancesList = append(balancesList, s)
-			}
-			v.Saved = false
-		}
-		h.Balance = false
+		held := h.Balance
 		h.Mu.Unlock()
 
-		for {
-			count := len(balancesList)
+		if held {
+			sleep(ctx, 100*time.Millisecond)
+		}
+	}
+}
 
-			if count == 0 {
-				break
-			}
+// save not saved balances from Server.UserBalances to database
+// balances which can never be written saved to dead letters
+// balance with not inserted transactions or not saved cancels is ahead of ledger. saved after they posted
+func (h *Server) flushBalances() error {
 
-			if count > 500 {
-				count = 500
-			}
+	balancesList := make([]models.UserBalance, 0)
 
-			chunkList := balancesList[:count]
-			var value []string
-			for _, data := range chunkList {
-				value = append(value, fmt.Sprintf("('%s',%.2f)", data.UserId, data.Amount))
-			}
+	h.Mu.Lock()
+	seq := h.walSeq()
+	unposted := h.unpostedUsers()
+	held := false
+	for k, v := range h.UserBalances {
+		if v.Saved && unposted[k] {
+			held = true
+			continue
+		}
 
-			if err := h.Repo.Db.Exec(fmt.Sprintf("UPDATE users AS u SET balance = data.a FROM (VALUES %s) AS data(user_id, a) WHERE u.user_id = data.user_id", strings.Join(value, ","))).Error; err != nil {
-				log.Println(err)
-				continue
+		if v.Saved {
+			s := models.UserBalance{
+				UserId: k,
+				Amount: v.Amount,
 			}
+			balancesList = append(balancesList, s)
+			v.Saved = false
+			h.UserBalances[k] = v
+		}
+	}
+	h.Balance = held
+	h.Mu.Unlock()
+
+	for {
+		count := len(balancesList)
+
+		if count == 0 {
+			break
+		}
 
-			balancesList = balancesList[count:]
+		// maximum 500 rows per operation for safe database usage
+		if count > 500 {
+			count = 500
 		}
 
-		// log.Println("Rows inserted:", len(balancesList))
+		if err := h.writeBalances(balancesList[:count]); err != nil {
+			// not saved balances must be saved next time
+			h.markBalances(balancesList)
+			return err
+		}
+
+		balancesList = balancesList[count:]
+	}
+
+	h.Mu.Lock()
+	h.balancesSaved(seq)
+	h.Mu.Unlock()
+
+	// log.Println("Rows inserted:", len(balancesList))
+	return nil
+}
+
+// update batch of balances. batch with row error bisected until bad row found
+// rows of written halves are written again on next call if other half failed. update is idempotent
+func (h *Server) writeBalances(balances []models.UserBalance) error {
+
+	err := h.Repo.UpdateBalances(balances)
+	if err == nil || !service.RowError(err) {
+		return err
+	}
+
+	if len(balances) == 1 {
+		return h.deadLetter(balances[0], err)
+	}
+
+	half := len(balances) / 2
+	if err := h.writeBalances(balances[:half]); err != nil {
+		return err
+	}
+
+	return h.writeBalances(balances[half:])
+}
+
+// mark balances as not saved again. used when database update failed
+func (h *Server) markBalances(balances []models.UserBalance) {
+	h.Mu.Lock()
+	for _, v := range balances {
+		b := h.UserBalances[v.UserId]
+		b.Saved = true
+		h.UserBalances[v.UserId] = b
 	}
+	h.Balance = true
+	h.Mu.Unlock()
 }
 
 // check if user already registered and exists or not
@@ -128,10 +209,10 @@ func (h *Server) CheckUser(id string) bool {
 }
 
 // add new user to map Server.UserBalances
-func (h *Server) AddUser(id string) {
+func (h *Server) AddUser(id string, balance models.Money) {
 	h.Mu.Lock()
 	b := models.Balance{}
-	b.Amount = 0
+	b.Amount = balance
 	b.Saved = false
 	h.UserBalances[id] = b
 	h.Mu.Unlock()
@@ -141,9 +222,7 @@ func (h *Server) AddUser(id string) {
 func (h *Server) FetchData() error {
 
 	// get all users information for further use
-	users := make([]models.User, 0)
-
-	err := h.Repo.Db.Find(&users).Error
+	users, err := h.Repo.FetchUsers()
 	if err != nil {
 		return err
 	}
@@ -158,68 +237,188 @@ func (h *Server) FetchData() error {
 	}
 	h.Mu.Unlock()
 
-	// get all transactions information. not to allow repeating transaction id
-	transactions := make([]models.Data, 0)
+	// source types for request check
+	types, err := h.Repo.FetchSourceTypes()
+	if err != nil {
+		return err
+	}
+	h.SourceTypes.Load(types)
+
+	// providers for api key check
+	providers, err := h.Repo.FetchProviders()
+	if err != nil {
+		return err
+	}
+
+	h.Mu.Lock()
+	for _, v := range providers {
+		h.setProvider("", v)
+	}
+	h.Mu.Unlock()
 
-	err = h.Repo.Db.Find(&transactions).Error
+	// get all transactions information. not to allow repeating transaction id
+	transactions, err := h.Repo.FetchTransactions()
 	if err != nil {
 		return err
 	}
 
 	h.Mu.Lock()
 	for _, v := range transactions {
-		h.TransactionIds[v.TransactionId] = ""
+		h.TransactionIds[v.TransactionId] = outcomeOf(v)
 	}
 	h.Mu.Unlock()
 
-	return nil
+	// transactions accepted before crash or restart and not saved to database
+	return h.replayWAL()
 }
 
 // win state transaction
-func (h *Server) UserWin(id string, d *models.Data) (float64, error) {
+func (h *Server) UserWin(id string, d *models.Data) (models.Money, error) {
+
+	if h.Durable {
+		d.State = true
+		return h.applyTransaction(id, d)
+	}
 
 	h.Mu.Lock()
 	b := h.UserBalances[id]
 	b.Amount = b.Amount + d.Amount
-	b.Saved = true   // not saved
-	h.Balance = true // not saved balance in map
-	h.UserBalances[id] = b
-	h.Mu.Unlock()
-
 	d.State = true
 	d.Status = 1
-	h.SaveTransaction(*d)
-	//err = srv.CreateData(mData)
-	//if err != nil {
-	//	log.Println(err)
-	//	return err
-	//}
+	d.Balance = b.Amount
+
+	if err := h.bufferTransaction(id, b, d); err != nil {
+		h.Mu.Unlock()
+		return b.Amount - d.Amount, err
+	}
+	h.Mu.Unlock()
+
+	// balance changed in memory. not synced record can be lost with crash
+	if err := h.syncWAL(d.WalSeq); err != nil {
+		return b.Amount, err
+	}
 	return b.Amount, nil
 }
 
 // lose state transaction
-func (h *Server) UserLost(id string, d *models.Data) (float64, error) {
+func (h *Server) UserLost(id string, d *models.Data) (models.Money, error) {
+
+	if h.Durable {
+		return h.applyTransaction(id, d)
+	}
 
 	h.Mu.Lock()
 	b := h.UserBalances[id]
-	if (b.Amount - d.Amount) < 0 {
+	if (b.Amount-d.Amount) < 0 && !d.AllowNegative {
 		h.Mu.Unlock()
 		return b.Amount, fmt.Errorf("not enough user balance")
 	}
 
 	b.Amount = b.Amount - d.Amount
+	d.Status = 1
+	d.Balance = b.Amount
+
+	if err := h.bufferTransaction(id, b, d); err != nil {
+		h.Mu.Unlock()
+		return b.Amount + d.Amount, err
+	}
+	h.Mu.Unlock()
+
+	// balance changed in memory. not synced record can be lost with crash
+	if err := h.syncWAL(d.WalSeq); err != nil {
+		return b.Amount, err
+	}
+	return b.Amount, nil
+}
+
+// save changed balance and transaction record in memory. must be called with h.Mu locked
+// written to write-ahead log first. nothing changed if log write failed
+func (h *Server) bufferTransaction(id string, b models.Balance, d *models.Data) error {
+
+	if err := h.writeWAL(service.WALTransaction, d, &b.Amount, nil); err != nil {
+		return err
+	}
+
 	b.Saved = true   // user balance not saved
 	h.Balance = true // not saved balance in map
 	h.UserBalances[id] = b
+	h.enqueue(*d)
+
+	return nil
+}
+
+// durable mode transaction. user balance and transaction record committed together before response
+func (h *Server) applyTransaction(id string, d *models.Data) (models.Money, error) {
+
+	b, err := h.Repo.ApplyTransaction(d)
+	if err != nil {
+		return b, err
+	}
+
+	// balance already saved to database
+	h.Mu.Lock()
+	h.UserBalances[id] = models.Balance{Amount: b}
 	h.Mu.Unlock()
-	d.Status = 1
 
-	h.SaveTransaction(*d)
-	//err = srv.CreateData(mData)
-	//if err != nil {
-	//	log.Println(err)
-	//	return 0, err
-	//}
+	return b, nil
+}
 
-	return b.Amount, nil
+// @Summary User balance
+// @Security BearerAuth
+// @Tags users
+// @Description balance of user from memory cache (fast, can be ahead of database) and/or database (committed)
+// @Description with count of transactions not saved to database yet
+// @Produce json
+// @Param id path string true "user id"
+// @Param consistency query string false "cache / database / both. default both"
+// @Success 200 {object} models.Response
+// @Failure 400,401,403,404 {object} models.Response
+// @Failure 500 {object} models.Response
+// @Router /api/users/{id}/balance [get]
+func (h *Server) UserBalance(c echo.Context) error {
+
+	id := c.Param("id")
+
+	consistency := c.QueryParam("consistency")
+	if consistency == "" {
+		consistency = "both"
+	}
+
+	if consistency != "cache" && consistency != "database" && consistency != "both" {
+		return echo.NewHTTPError(http.StatusBadRequest, &models.Response{Error: true, Message: "consistency must be cache, database or both"})
+	}
+
+	info := models.BalanceInfo{UserId: id}
+
+	h.Mu.Lock()
+	b, cached := h.UserBalances[id]
+	if consistency != "database" && cached {
+		info.Cache = &b.Amount
+		info.Unsaved = b.Saved
+	}
+
+	info.PendingTotal = h.Transactions.Len()
+	h.Transactions.Each(func(v models.Data) {
+		if v.UserId == id {
+			info.Pending++
+		}
+	})
+	h.Mu.Unlock()
+
+	if consistency != "cache" {
+		user, err := h.Repo.FindUser(id)
+		if err != nil && err != service.ErrUserNotFound {
+			return echo.NewHTTPError(http.StatusInternalServerError, &models.Response{Error: true, Message: err.Error()})
+		}
+
+		if err == nil {
+			info.Database = &user.Balance
+		}
+	}
+
+	if info.Cache == nil && info.Database == nil {
+		return echo.NewHTTPError(http.StatusNotFound, &models.Response{Error: true, Message: "user didnt registered"})
+	}
+
+	return c.JSON(http.StatusOK, &models.Response{Message: "balance", Data: info})
 }
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"github.com/SaCavid/simple-task/models"
+	"github.com/SaCavid/simple-task/service"
+	"log"
+)
+
+// write record to write-ahead log. must be called with h.Mu locked
+// so records order is same as order of changes in memory
+// balance --> user balance after operation. nil if balance not changed
+// cancel --> audit row of cancel record
+func (h *Server) writeWAL(kind string, data *models.Data, balance *models.Money, cancel *models.Cancellation) error {
+	if h.Wal == nil {
+		return nil
+	}
+
+	r := service.WALRecord{Kind: kind, Data: *data, Balance: balance, Cancel: cancel}
+	if err := h.Wal.Write(&r); err != nil {
+		return err
+	}
+
+	data.WalSeq = r.Seq
+	return nil
+}
+
+// fsync write-ahead log before response. must be called without h.Mu locked
+// after failed fsync file state is unknown. log refuses new records, requests fail with 503 until restart and replay
+func (h *Server) syncWAL(seq uint64) error {
+	if h.Wal == nil || seq == 0 {
+		return nil
+	}
+
+	return h.Wal.Sync(seq)
+}
+
+// all balances saved to database. wal records written before are not needed for balances
+// must be called with h.Mu locked
+func (h *Server) balancesSaved(seq uint64) {
+	if seq > h.walBalanceSeq {
+		h.walBalanceSeq = seq
+	}
+}
+
+// last written wal record
+func (h *Server) walSeq() uint64 {
+	if h.Wal == nil {
+		return 0
+	}
+
+	return h.Wal.Seq()
+}
+
+// remove wal records saved to database
+// record is saved if transaction inserted, balance updated and cancel status saved
+func (h *Server) compactWAL() {
+	if h.Wal == nil {
+		return
+	}
+
+	h.Mu.Lock()
+	upTo := h.walBalanceSeq
+
+	// buffer is in wal order. first transaction is oldest not inserted record
+	if oldest, ok := h.Transactions.Oldest(); ok && oldest.WalSeq > 0 && oldest.WalSeq-1 < upTo {
+		upTo = oldest.WalSeq - 1
+	}
+
+	for _, v := range h.cancelPending {
+		if v.data.WalSeq > 0 && v.data.WalSeq-1 < upTo {
+			upTo = v.data.WalSeq - 1
+		}
+	}
+
+	compacted := h.walCompacted
+	h.Mu.Unlock()
+
+	if upTo <= compacted {
+		return
+	}
+
+	if err := h.Wal.Compact(upTo); err != nil {
+		log.Println(err)
+		return
+	}
+
+	h.Mu.Lock()
+	h.walCompacted = upTo
+	h.Mu.Unlock()
+}
+
+// replay write-ahead log after database information loaded
+// not inserted transactions returned to buffer and user balances restored
+func (h *Server) replayWAL() error {
+	if h.Wal == nil {
+		return nil
+	}
+
+	records, err := h.Wal.Records()
+	if err != nil {
+		return err
+	}
+
+	// last balance of every user in log
+	balances := make(map[string]models.Money)
+
+	for _, r := range records {
+		if r.Balance != nil {
+			balances[r.Data.UserId] = *r.Balance
+		}
+
+		d := r.Data
+		d.WalSeq = r.Seq
+
+		switch r.Kind {
+		case service.WALTransaction:
+			h.Mu.Lock()
+			if _, ok := h.TransactionIds[d.TransactionId]; !ok {
+				h.TransactionIds[d.TransactionId] = outcomeOf(d)
+				h.enqueue(d)
+			}
+			h.Mu.Unlock()
+		case service.WALCancel:
+			c := models.NewCancellation(d, models.ReasonPostProcessing, "")
+			if r.Cancel != nil {
+				c = *r.Cancel
+			} else if r.Balance != nil {
+				c.Apply(d, *r.Balance+d.Delta())
+			}
+
+			// saved only if record still processed. balance of record restored below
+			err := h.Repo.CancelTransaction(&d, &c)
+			if err != nil && err != service.ErrAlreadyCanceled {
+				log.Println("Cancel not saved. will be saved with post processing:", err)
+
+				h.Mu.Lock()
+				if h.cancelPending == nil {
+					h.cancelPending = make(map[uint]pendingCancel)
+				}
+				h.cancelPending[d.ID] = pendingCancel{data: d, cancel: c}
+				h.Mu.Unlock()
+			}
+		}
+	}
+
+	h.Mu.Lock()
+	for id, b := range balances {
+		h.UserBalances[id] = models.Balance{Amount: b, Saved: true}
+		h.Balance = true
+	}
+	h.Mu.Unlock()
+
+	log.Println("Write-ahead log replayed. records:", len(records))
+	return nil
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/SaCavid/simple-task/handlers"
 	"github.com/SaCavid/simple-task/models"
@@ -10,8 +13,11 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
-
 )
 
 // @title Simple Task
@@ -21,46 +27,188 @@ import (
 // @host localhost
 // @BasePath /
 
-// @securityDefinitions.apikey ApiKeyAuth
+// @securityDefinitions.apikey ProviderKeyAuth
+// @in header
+// @name X-Api-Key
+
+// @securityDefinitions.apikey BearerAuth
 // @in header
 // @name Authorization
 
 func main() {
 	log.SetFlags(log.Lshortfile)
 
+	// reconciliation command. report written to stdout and server not started
+	reconcile := flag.Bool("reconcile", false, "compare users.balance with balance recomputed from transaction records and exit")
+	format := flag.String("format", "json", "report format of reconcile: json or csv")
+	repair := flag.Bool("repair", false, "reconcile sets users.balance to recomputed balance")
+
+	// token command. HS256 bearer token signed with JWT_SECRET written to stdout and server not started
+	token := flag.String("token", "", "print bearer token of role (admin / user / provider) and exit")
+	subject := flag.String("subject", "admin", "subject of token: admin name, user id or provider id")
+	ttl := flag.Duration("ttl", 24*time.Hour, "lifetime of token")
+
+	// local development. public development secret used when JWT_SECRET empty
+	dev := flag.Bool("dev", false, "allow public development JWT secret. never in production")
+	flag.Parse()
+
 	// loads values from .env into the system
 	if err := godotenv.Load(); err != nil {
 		log.Print("No .env file found")
 	}
 
+	// database not needed
+	secret, err := jwtSecret(*dev)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *token != "" {
+		os.Exit(tokenCommand(secret, *token, *subject, *ttl))
+	}
+
 	// can be changed in env file. default 8080
 	port := os.Getenv("HTTP_SERVER_PORT")
 
+	repo, err := service.NewTaskRepository(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// initialize server
 	srv := handlers.Server{
-		TransactionIds: make(map[string]string, 0),
+		TransactionIds: make(map[string]models.Outcome, 0),
 		UserBalances:   make(map[string]models.Balance, 0),
-		Repo:           service.NewTaskRepository(os.Getenv("DATABASE_URL")),
+		Providers:      make(map[string]models.Provider, 0),
+		SourceTypes:    handlers.NewSourceTypes(nil),
+		Repo:           repo,
+
+		// can be changed in env file. default buffered
+		Durable: os.Getenv("PERSISTENCE_MODE") == "durable",
+	}
+
+	// in-memory balances of running instance not loaded. write-ahead log not replayed
+	if *reconcile {
+		os.Exit(reconcileCommand(&srv, *format, *repair))
+	}
+
+	// which requests use transaction id. can be changed in env file. default any
+	if os.Getenv("TRANSACTION_ID_POLICY") == "validated" {
+		srv.IdPolicy = handlers.BurnValidated
+	}
+
+	// bearer tokens. HS256 with secret and RS256 with keys of local JWKS file
+	// can be changed in env file. both empty --> only api keys of providers accepted
+	if jwks := os.Getenv("JWKS_PATH"); secret != "" || jwks != "" {
+		srv.Jwt, err = service.NewJWTVerifier(secret, jwks)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// allowed age of signed provider requests in seconds. can be changed in env file. default 300
+	if w, err := strconv.Atoi(os.Getenv("SIGNATURE_WINDOW")); err == nil && w > 0 {
+		srv.SignatureWindow = time.Duration(w) * time.Second
+	}
+
+	// bulk insert of buffered mode. rows per insert and longest wait. can be changed in env file. default 5000 and 200ms
+	if b, err := strconv.Atoi(os.Getenv("INSERT_BATCH")); err == nil && b > 0 {
+		srv.InsertBatch = b
+	}
+
+	if d, err := time.ParseDuration(os.Getenv("INSERT_DELAY")); err == nil && d > 0 {
+		srv.InsertDelay = d
+	}
+
+	// write-ahead log for buffered mode. can be changed in env file. empty --> disabled
+	if p := os.Getenv("WAL_PATH"); p != "" && !srv.Durable {
+		srv.Wal, err = service.OpenWAL(p)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	// fetching database information about users and transactions for further use
-	err := srv.FetchData()
+	// write-ahead log replayed. not saved transactions can't be lost
+	err = srv.FetchData()
 	if err != nil {
-		log.Println(err)
+		log.Fatal(err)
+	}
+
+	// post processing selection. can be changed in env file. empty --> 10 latest odd records
+	if p := os.Getenv("CANCEL_POLICY"); p != "" {
+		srv.CancelPolicy, err = handlers.ParseCancelPolicy(p, srv.SourceTypes)
+		if err != nil {
+			log.Fatal("CANCEL_POLICY: ", err)
+		}
+	}
+
+	// post processing schedule. cron expression. can be changed in env file. empty --> every N_MINUTES
+	if s := os.Getenv("CANCEL_SCHEDULE"); s != "" {
+		srv.CancelSchedule, err = handlers.ParseSchedule(s)
+		if err != nil {
+			log.Fatal("CANCEL_SCHEDULE: ", err)
+		}
+	}
+
+	// canceled on SIGINT / SIGTERM. background workers stopped with this context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	var workers sync.WaitGroup
+	worker := func(run func(ctx context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run(ctx)
+		}()
 	}
 
 	// goroutine for bulk inserting transaction information to database
-	go srv.BulkInsertTransactions()
+	worker(srv.BulkInsertTransactions)
 
+	// singleton jobs
 	// goroutine updating user balances depended on transactions. bulk update.
-	go srv.BulkUpdateBalances()
-
 	// -- post processing task
 	// Every N minutes 10 latest odd records must be canceled and balance should be corrected by the application.
 	// Cancelled records shouldn't be processed twice.
 	// can be changed from env file
-	// default 5 minutes
-	go srv.PostProcessing()
+	// default 5 minutes. selection and schedule with CANCEL_POLICY and CANCEL_SCHEDULE
+	jobs := []func(ctx context.Context){srv.BulkUpdateBalances, srv.PostProcessing}
+
+	// reconciliation job. balances compared with balance recomputed from transaction records
+	// can be changed in env file. empty --> disabled
+	if i := os.Getenv("RECONCILE_INTERVAL"); i != "" {
+		srv.ReconcileInterval, err = time.ParseDuration(i)
+		if err != nil || srv.ReconcileInterval <= 0 {
+			log.Fatal("RECONCILE_INTERVAL: must be positive duration. example: 1h")
+		}
+
+		srv.ReconcileRepair = os.Getenv("RECONCILE_REPAIR") == "true"
+		srv.ReconcileDir = os.Getenv("RECONCILE_DIR")
+		jobs = append(jobs, srv.Reconciliation)
+	}
+
+	// replicas. singleton jobs run only by instance holding postgres advisory lock
+	// can be changed in env file. default false --> one instance
+	if os.Getenv("LEADER_ELECTION") == "true" {
+		// buffered balances are in memory of instance accepted transaction. only durable mode can be replicated
+		if !srv.Durable {
+			log.Fatal("LEADER_ELECTION: replicas must use PERSISTENCE_MODE = durable")
+		}
+
+		lock := service.NewAdvisoryLock(repo.Db, "simple-task singleton jobs")
+		worker(func(ctx context.Context) {
+			srv.Leader(ctx, lock, jobs...)
+		})
+	} else {
+		for _, job := range jobs {
+			worker(job)
+		}
+	}
 
 	// starting HTTP route
 	e := echo.New()
@@ -70,16 +218,172 @@ func main() {
 		return c.String(http.StatusOK, "-------\n\nThe main goal of this test task is to develop the application for processing the incoming requests from the 3d-party providers.\nThe application must have an HTTP URL to receive incoming POST requests.\nTo receive the incoming POST requests the application must have an HTTP URL endpoint.\n\nTechnologies: Golang + Postgres.\n\nRequirements:\n1. Processing and saving incoming requests.\n\nImagine that we have a user with the account balance.\n\nExample of the POST request:\nPOST /your_url HTTP/1.1\nSource-Type: client\nContent-Length: 34\nHost: 127.0.0.1\nContent-Type: application/json\n{\"state\": \"win\", \"amount\": \"10.15\", \"transactionId\": \"some generated identificator\"}\n\nHeader “Source-Type” could be in 3 types (game, server, payment). This type probably can be extended in the future.\n\nPossible states (win, lost):\n1. Win requests must increase the user balance\n2. Lost requests must decrease user balance.\nEach request (with the same transaction id) must be processed only once.\n\nThe decision regarding database architecture and table structure is made to you.\n\nYou should know that account balance can't be in a negative value.\nThe application must be competitive ability.\n\n2. Post-processing\nEvery N minutes 10 latest odd records must be canceled and balance should be corrected by the application.\nCancelled records shouldn't be processed twice.\n\n3. The application should be prepared for running via docker containers.\n\nPlease be informed and kindly note that application without description about how to run and test won't be accepted and reviewed. \n\n---------")
 	})
 
+	admin := srv.Auth(handlers.RoleAdmin)
+
 	// for registering users
-	e.GET("/api/users", srv.FetchUsersForTesting)
-	e.POST("/api/register", srv.Register)
+	e.GET("/api/users", srv.FetchUsersForTesting, admin)
+	e.POST("/api/register", srv.Register, admin)
+
+	// user balance from memory cache and database. user token --> only own balance
+	e.GET("/api/users/:id/balance", srv.UserBalance, srv.Auth(handlers.RoleUser, handlers.RoleAdmin), srv.OwnUser)
+
+	// transaction history of user with filters and pagination. user token --> only own history
+	e.GET("/api/users/:id/transactions", srv.UserTransactions, srv.Auth(handlers.RoleUser, handlers.RoleAdmin), srv.OwnUser)
+
+	// ledger postings of user account. user token --> only own ledger
+	e.GET("/api/users/:id/ledger", srv.UserLedger, srv.Auth(handlers.RoleUser, handlers.RoleAdmin), srv.OwnUser)
+
+	// users.balance compared with ledger
+	e.GET("/api/ledger/check", srv.CheckLedger, admin)
+
+	// balances compared with balance recomputed from transaction records. json or csv report
+	// post --> balances of users without pending changes repaired
+	e.GET("/api/reconciliation", srv.ReconciliationReport, admin)
+	e.POST("/api/reconciliation", srv.RepairBalances, admin)
+
+	// balances which can never be saved. kept instead of retrying forever
+	e.GET("/api/dead-letters", srv.FetchDeadLetters, admin)
+
+	// main route for processing transactions. providers authenticated with api key
+	// request body signature checked for providers with hmac secret
+	e.POST("/api/processing", srv.Handler, srv.ProviderAuth, srv.SignatureAuth)
+
+	// source types management. new source types and disabling without rebuild
+	sourceTypes := e.Group("/api/source-types", admin)
+	sourceTypes.GET("", srv.FetchSourceTypes)
+	sourceTypes.POST("", srv.CreateSourceType)
+	sourceTypes.PUT("/:id", srv.UpdateSourceType)
+
+	// provider api keys management
+	providers := e.Group("/api/providers", admin)
+	providers.GET("", srv.FetchProviders)
+	providers.POST("", srv.CreateProvider)
+	providers.POST("/:id/rotate", srv.RotateProvider)
+	providers.DELETE("/:id", srv.RevokeProvider)
+	providers.POST("/:id/secret", srv.RotateProviderSecret)
+	providers.DELETE("/:id/secret", srv.RemoveProviderSecret)
+
+	// buffered transactions waiting for bulk insert
+	e.GET("/api/queue", srv.InsertQueue, admin)
+
+	// status of transaction for providers
+	e.GET("/api/transactions/:transactionId", srv.TransactionStatus, srv.Auth(handlers.RoleProvider, handlers.RoleAdmin))
+
+	// manual cancel or partial refund of transaction. requester and reason saved with cancellation
+	e.POST("/api/admin/transactions/:transactionId/cancel", srv.ManualCancel, admin)
 
-	// main route for processing transactions
-	e.POST("/api/processing", srv.Handler)
 	s := &http.Server{
+		Addr:        fmt.Sprintf(":%s", port),
 		ReadTimeout: 5 * time.Second,
 	}
 
 	// starting HTTP server
-	e.Logger.Fatal(e.Start(fmt.Sprintf(":%s", port)), s)
+	go func() {
+		if err := e.StartServer(s); err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	<-sig
+	log.Println("Shutting down")
+
+	// stop accepting requests and wait for in-flight handlers
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer shutdownCancel()
+
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Println(err)
+	}
+
+	// stop background workers. current database operations finished before return
+	cancel()
+	workers.Wait()
+
+	// save everything left in memory
+	if err := srv.Flush(); err != nil {
+		log.Println("Flush failed:", err)
+		os.Exit(1)
+	}
+
+	if srv.Wal != nil {
+		srv.Wal.Close()
+	}
+
+	log.Println("All transactions and balances saved")
+}
+
+// one reconciliation. exit code 2 --> discrepancies left not repaired
+func reconcileCommand(srv *handlers.Server, format string, repair bool) int {
+
+	if format != "json" && format != "csv" {
+		log.Println("format must be json or csv")
+		return 1
+	}
+
+	report, err := srv.Reconcile(repair)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	if format == "csv" {
+		err = report.WriteCSV(os.Stdout)
+	} else {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	}
+
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	for _, d := range report.Discrepancies {
+		if !d.Repaired {
+			return 2
+		}
+	}
+
+	return 0
+}
+
+// public secret of local development. accepted only with -dev flag
+const devJwtSecret = "dev-secret-change-me"
+
+// secret of HS256 tokens from env file. -dev --> development secret if empty
+// development secret without -dev refused. anybody can mint admin token with it
+func jwtSecret(dev bool) (string, error) {
+
+	secret := os.Getenv("JWT_SECRET")
+	if dev && secret == "" {
+		log.Println("JWT_SECRET: development secret used. never use -dev in production")
+		return devJwtSecret, nil
+	}
+
+	if secret == devJwtSecret && !dev {
+		return "", fmt.Errorf("JWT_SECRET is public development secret. set own secret or use -dev flag")
+	}
+
+	return secret, nil
+}
+
+// exit code 1 --> unknown role or no JWT_SECRET
+func tokenCommand(secret, role, subject string, ttl time.Duration) int {
+
+	switch role {
+	case handlers.RoleAdmin, handlers.RoleUser, handlers.RoleProvider:
+	default:
+		log.Printf("unknown role %q. admin, user or provider", role)
+		return 1
+	}
+
+	token, err := service.SignToken(secret, role, subject, ttl)
+	if err != nil {
+		log.Println("JWT_SECRET:", err)
+		return 1
+	}
+
+	fmt.Println(token)
+	return 0
 }
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// outcomes of cancellation
+const (
+	CancelApplied = "applied" // record canceled - 3 and user balance corrected
+	CancelDenied  = "denied"  // balance cant be negative. record cancel denied - 4. never selected by post processing again, can be canceled manually
+)
+
+// reason of cancellations made by post processing
+const ReasonPostProcessing = "post processing"
+
+type (
+	// audit record of every cancel decision. one applied row per canceled transaction record
+	Cancellation struct {
+		gorm.Model
+		DataId        uint   `gorm:"index" json:"dataId"` // canceled transaction record
+		TransactionId string `json:"transactionId"`
+		UserId        string `json:"userId"`
+		Amount        Money  `gorm:"type:numeric(20,2);not null;default:0" json:"amount"` // reversed amount. less than record amount for partial refund
+		Reason        string `json:"reason"`
+		Policy        string `json:"policy,omitempty"`    // cancel policy of post processing selection
+		Requester     string `json:"requester,omitempty"` // subject of admin token for manual cancel
+		Outcome       string `json:"outcome"`
+		BalanceBefore Money  `gorm:"type:numeric(20,2);not null;default:0" json:"balanceBefore"`
+		BalanceAfter  Money  `gorm:"type:numeric(20,2);not null;default:0" json:"balanceAfter"` // same as before for denied cancel
+	}
+
+	// manual cancel request
+	CancelRequest struct {
+		Amount string `json:"amount"` // partial refund. empty --> whole amount of record
+		Reason string `json:"reason"`
+	}
+)
+
+// cancellation of whole amount of transaction record. outcome and balances set when cancel applied or denied
+func NewCancellation(d Data, reason, policy string) Cancellation {
+	return Cancellation{DataId: d.ID, TransactionId: d.TransactionId, UserId: d.UserId, Amount: d.Amount, Reason: reason, Policy: policy}
+}
+
+// part of balance change of record reversed by cancel. balance after cancel = balance before - Delta
+// amount 0 --> whole amount of record
+func (c Cancellation) Delta(d Data) Money {
+	if c.Amount == 0 {
+		return d.Delta()
+	}
+
+	if d.State {
+		return c.Amount
+	}
+
+	return -c.Amount
+}
+
+// set outcome. balance --> user balance before cancel
+func (c *Cancellation) Apply(d Data, balance Money) {
+	c.Outcome = CancelApplied
+	c.BalanceBefore = balance
+	c.BalanceAfter = balance - c.Delta(d)
+}
+
+func (c *Cancellation) Deny(balance Money) {
+	c.Outcome = CancelDenied
+	c.BalanceBefore = balance
+	c.BalanceAfter = balance
+}
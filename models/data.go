@@ -1,33 +1,142 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// transaction record statuses
+const (
+	StatusProcessed    uint8 = 1
+	StatusError        uint8 = 2
+	StatusCanceled     uint8 = 3
+	StatusCancelDenied uint8 = 4
 )
 
 type (
 	User struct {
 		gorm.Model
 		UserId  string `gorm:"index"`
-		Balance float64
+		Balance Money  `gorm:"type:numeric(20,2);not null;default:0"` // projection of ledger. written only if equal to sum of user account postings
 	}
 
 	Balance struct {
-		Amount float64
+		Amount Money
 		Saved  bool // if true this balance didnt saved to the database
 	}
 
+	// user balance prepared for bulk update
+	UserBalance struct {
+		UserId string
+		Amount Money
+	}
+
 	Data struct {
 		gorm.Model
 		UserId        string
-		State         bool    // transaction win - lose state
-		Status        uint8   // operation status processed -1 / error denied -2 / canceled -3 / cancel denied -4 and etc
-		Source        int     // source of operation
-		Amount        float64 // amount of operation
-		TransactionId string  `gorm:"index"` // unique transaction id
+		State         bool   // transaction win - lose state
+		Status        uint8  // operation status processed -1 / error denied -2 / canceled -3 / cancel denied -4 and etc
+		Source        int    // source of operation
+		ProviderId    uint   `gorm:"not null;default:0"`                    // provider sent request. 0 --> record before providers
+		Amount        Money  `gorm:"type:numeric(20,2);not null;default:0"` // amount of operation
+		TransactionId string `gorm:"index"`                                 // unique transaction id
+		Balance       Money  `gorm:"type:numeric(20,2);not null;default:0"` // user balance after processed operation
+
+		// saved response for idempotent replay of same transaction id
+		RequestHash string // hash of user, state, amount and source of request
+		Code        int    // response status code
+		Message     string // response message
+
+		WalSeq        uint64 `gorm:"-" json:"-"` // write-ahead log record of buffered transaction. not saved to database
+		AllowNegative bool   `gorm:"-" json:"-"` // rule of source type. balance can be negative after operation
+	}
+
+	// response of transaction id. repeated request with same transaction id gets same response
+	Outcome struct {
+		RequestHash string
+		Code        int // 0 --> request still processing
+		Response    Response
+	}
+
+	// transaction status for providers
+	TransactionInfo struct {
+		Id            uint      `json:"id,omitempty"` // 0 --> not saved to database yet
+		TransactionId string    `json:"transactionId"`
+		UserId        string    `json:"userId"`
+		State         string    `json:"state"`
+		Status        string    `json:"status"`
+		Source        string    `json:"source"`
+		Amount        Money     `json:"amount"`
+		Balance       Money     `json:"balance"`
+		Pending       bool      `json:"pending"` // true --> accepted but not saved to database yet
+		CreatedAt     time.Time `json:"createdAt"`
+		UpdatedAt     time.Time `json:"updatedAt"`
+
+		Cancellations []Cancellation `json:"cancellations,omitempty"` // applied or denied cancels of record
+	}
+
+	// user balance from memory cache and database
+	BalanceInfo struct {
+		UserId   string `json:"userId"`
+		Cache    *Money `json:"cache,omitempty"`    // in-memory balance. can be ahead of database
+		Database *Money `json:"database,omitempty"` // committed balance
+		Unsaved  bool   `json:"unsaved"`            // cache balance changed and not saved to database yet
+
+		Pending      int `json:"pending"`      // transactions of user not inserted to database
+		PendingTotal int `json:"pendingTotal"` // transactions of all users not inserted to database
+	}
+
+	// buffered transactions waiting for bulk insert
+	QueueInfo struct {
+		Depth    int    `json:"depth"`    // transactions not inserted to database
+		Batch    int    `json:"batch"`    // transactions per bulk insert
+		Delay    string `json:"delay"`    // longest wait of not full batch
+		Inserted uint64 `json:"inserted"` // inserted since start
+		Failures uint64 `json:"failures"` // failed bulk inserts since start
+		Dropped  uint64 `json:"dropped"`  // saved to dead letters since start. can never be inserted
+	}
+
+	// filter for user transaction history. nil or zero values --> not filtered
+	// keyset pagination. records with id less than Cursor ordered from latest
+	TransactionFilter struct {
+		UserId    string
+		State     *bool
+		Status    uint8
+		Source    *int
+		MinAmount *Money
+		MaxAmount *Money
+		From      time.Time // created_at >= From
+		To        time.Time // created_at < To
+		Cursor    uint
+		Limit     int
+	}
+
+	// selection of transaction records canceled by post processing. latest first
+	CancelFilter struct {
+		Parity    int // 1 --> odd ids, 2 --> even ids, 0 --> all ids
+		UserId    string
+		Source    *int
+		Exclude   []int // source types never canceled
+		MinAmount *Money
+		MaxAmount *Money
+		From      time.Time // created_at >= From
+		To        time.Time // created_at < To
+		Limit     int
+	}
+
+	// one page of user transaction history
+	TransactionPage struct {
+		Transactions []TransactionInfo `json:"transactions"`
+		NextCursor   uint              `json:"nextCursor,omitempty"` // 0 --> last page
 	}
 
 	JsonData struct {
+		UserId        string `json:"userId"`
 		State         string `json:"state"`
 		Source        string `json:"source"`
 		Amount        string `json:"amount"`
@@ -42,6 +151,17 @@ type (
 	}
 )
 
+// hash of request fields. same transaction id must be used only with same request
+func (d JsonData) RequestHash(userId string) string {
+	h := sha256.New()
+	for _, v := range []string{userId, d.State, d.Amount, d.Source} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 func (d JsonData) ValidateData() error {
 
 	if d.State == "" {
@@ -58,9 +178,129 @@ func (d JsonData) ValidateData() error {
 		return fmt.Errorf("transaction id cant be null")
 	}
 
+	if !ValidId(d.TransactionId) {
+		return fmt.Errorf("transaction id must be utf-8 without null character")
+	}
+
+	if !ValidId(d.UserId) {
+		return fmt.Errorf("user id must be utf-8 without null character")
+	}
+
 	if d.Amount == "" {
 		return fmt.Errorf("amount cant be null")
 	}
 
 	return nil
 }
+
+// id can be saved to text column. postgres rejects null character and invalid utf-8
+func ValidId(id string) bool {
+	return utf8.ValidString(id) && !strings.ContainsRune(id, 0)
+}
+
+// balance change of processed transaction. win --> +amount / lose --> -amount
+func (d Data) Delta() Money {
+	if d.State {
+		return d.Amount
+	}
+
+	return -d.Amount
+}
+
+// state name as in requests
+func (d Data) StateName() string {
+	if d.State {
+		return "win"
+	}
+
+	return "lose"
+}
+
+func (d Data) StatusName() string {
+	switch d.Status {
+	case StatusProcessed:
+		return "processed"
+	case StatusError:
+		return "error"
+	case StatusCanceled:
+		return "canceled"
+	case StatusCancelDenied:
+		return "cancel denied"
+	}
+
+	return "unknown"
+}
+
+// status code from name. names same as StatusName
+func ParseStatus(name string) (uint8, error) {
+	for _, v := range []uint8{StatusProcessed, StatusError, StatusCanceled, StatusCancelDenied} {
+		if (Data{Status: v}).StatusName() == name {
+			return v, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown status %s", name)
+}
+
+// record matches filter. same conditions as database query
+func (f TransactionFilter) Match(d Data) bool {
+	switch {
+	case d.UserId != f.UserId:
+		return false
+	case f.Cursor > 0 && d.ID >= f.Cursor:
+		return false
+	case f.State != nil && d.State != *f.State:
+		return false
+	case f.Status != 0 && d.Status != f.Status:
+		return false
+	case f.Source != nil && d.Source != *f.Source:
+		return false
+	case f.MinAmount != nil && d.Amount < *f.MinAmount:
+		return false
+	case f.MaxAmount != nil && d.Amount > *f.MaxAmount:
+		return false
+	case !f.From.IsZero() && d.CreatedAt.Before(f.From):
+		return false
+	case !f.To.IsZero() && !d.CreatedAt.Before(f.To):
+		return false
+	}
+
+	return true
+}
+
+// id parity of CancelFilter
+const (
+	ParityAny = iota
+	ParityOdd
+	ParityEven
+)
+
+// same as database query of CancelFilter
+func (f CancelFilter) Match(d Data) bool {
+	switch {
+	case f.Parity == ParityOdd && d.ID%2 != 1:
+		return false
+	case f.Parity == ParityEven && d.ID%2 != 0:
+		return false
+	case f.UserId != "" && d.UserId != f.UserId:
+		return false
+	case f.Source != nil && d.Source != *f.Source:
+		return false
+	case f.MinAmount != nil && d.Amount < *f.MinAmount:
+		return false
+	case f.MaxAmount != nil && d.Amount > *f.MaxAmount:
+		return false
+	case !f.From.IsZero() && d.CreatedAt.Before(f.From):
+		return false
+	case !f.To.IsZero() && !d.CreatedAt.Before(f.To):
+		return false
+	}
+
+	for _, v := range f.Exclude {
+		if d.Source == v {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// dead letter kinds
+const (
+	DeadLetterBalance     = "balance"     // user balance update
+	DeadLetterTransaction = "transaction" // buffered transaction record
+)
+
+// row which can never be written to database. saved instead of retrying forever
+type DeadLetter struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	Kind      string    `gorm:"index" json:"kind"`
+	Key       string    `json:"key"`                      // quoted id of row. exact bytes of invalid ids kept
+	Payload   string    `gorm:"type:text" json:"payload"` // json of row
+	Error     string    `gorm:"type:text" json:"error"`
+	CreatedAt time.Time `json:"createdAt"`
+}
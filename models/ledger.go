@@ -0,0 +1,166 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// ledger account kinds
+const (
+	AccountUser     = "user"
+	AccountProvider = "provider"
+	AccountHouse    = "house"
+)
+
+// account of records without provider and opening balances
+const HouseAccount = AccountHouse
+
+// journal entry kinds
+const (
+	EntryOpening     = "opening"     // user balance before ledger or registered with balance
+	EntryTransaction = "transaction" // processed win or lose
+	EntryCancel      = "cancel"      // applied cancellation. reversed part of record
+	EntryAdjustment  = "adjustment"  // balance repaired by reconciliation or dead letter transaction
+)
+
+type (
+	// ledger account. balance of account is sum of its postings
+	Account struct {
+		Code      string    `gorm:"primary_key" json:"code"` // user:<user id> / provider:<provider id> / house
+		Kind      string    `json:"kind"`
+		CreatedAt time.Time `json:"createdAt"`
+	}
+
+	// balanced set of postings. sum of posting amounts is 0
+	JournalEntry struct {
+		ID             uint      `gorm:"primary_key" json:"id"`
+		Kind           string    `json:"kind"`
+		DataId         uint      `gorm:"index" json:"dataId,omitempty"`         // transaction record. 0 --> opening
+		CancellationId uint      `gorm:"index" json:"cancellationId,omitempty"` // applied cancellation
+		CreatedAt      time.Time `json:"createdAt"`
+
+		Postings []Posting `gorm:"-" json:"postings,omitempty"`
+	}
+
+	// balance change of account. positive --> balance of account increased
+	Posting struct {
+		ID      uint   `gorm:"primary_key" json:"-"`
+		EntryId uint   `gorm:"index" json:"entryId"`
+		Account string `gorm:"index" json:"account"`
+		Amount  Money  `gorm:"type:numeric(20,2);not null;default:0" json:"amount"`
+	}
+
+	// posting of user account with entry info. user balance after posting in Balance
+	LedgerLine struct {
+		EntryId        uint      `json:"entryId"`
+		Kind           string    `json:"kind"`
+		DataId         uint      `json:"dataId,omitempty"`
+		CancellationId uint      `json:"cancellationId,omitempty"`
+		Amount         Money     `json:"amount"`
+		Balance        Money     `json:"balance"`
+		CreatedAt      time.Time `json:"createdAt"`
+	}
+
+	// users.balance compared with sum of user account postings
+	LedgerReport struct {
+		Entries    int              `json:"entries"`
+		Unbalanced []uint           `json:"unbalanced"` // entries with postings sum not 0
+		Users      []LedgerDiff     `json:"users"`      // users with different balance and ledger
+		Accounts   map[string]Money `json:"accounts"`   // balances of house and provider accounts
+
+		// buffered transactions and balances not saved to database. users can differ until saved
+		Pending int `json:"pending"`
+	}
+
+	LedgerDiff struct {
+		UserId  string `json:"userId"`
+		Balance Money  `json:"balance"` // users.balance
+		Ledger  Money  `json:"ledger"`  // sum of user account postings
+	}
+)
+
+func UserAccount(userId string) string {
+	return AccountUser + ":" + userId
+}
+
+func ProviderAccount(providerId uint) string {
+	return fmt.Sprintf("%s:%d", AccountProvider, providerId)
+}
+
+// kind of account from code
+func AccountKind(code string) string {
+	for _, k := range []string{AccountUser, AccountProvider} {
+		if len(code) > len(k) && code[:len(k)+1] == k+":" {
+			return k
+		}
+	}
+
+	return AccountHouse
+}
+
+// counterparty of user. provider pays wins and gets loses. house for records without provider
+func (d Data) Counterparty() string {
+	if d.ProviderId == 0 {
+		return HouseAccount
+	}
+
+	return ProviderAccount(d.ProviderId)
+}
+
+// entry of processed record. user balance changed by delta of record
+func TransactionEntry(d Data) JournalEntry {
+	return pair(EntryTransaction, d, d.Delta())
+}
+
+// entry of applied cancellation. cancel amount reversed
+func CancelEntry(d Data, c Cancellation) JournalEntry {
+	e := pair(EntryCancel, d, -c.Delta(d))
+	e.CancellationId = c.ID
+	return e
+}
+
+// balance of user before ledger. house is counterparty
+func OpeningEntry(u User) JournalEntry {
+	return JournalEntry{
+		Kind:      EntryOpening,
+		CreatedAt: time.Now(),
+		Postings: []Posting{
+			{Account: UserAccount(u.UserId), Amount: u.Balance},
+			{Account: HouseAccount, Amount: -u.Balance},
+		},
+	}
+}
+
+// balance of user repaired or dead letter transaction kept in balance. house is counterparty
+func AdjustmentEntry(userId string, amount Money) JournalEntry {
+	return JournalEntry{
+		Kind:      EntryAdjustment,
+		CreatedAt: time.Now(),
+		Postings: []Posting{
+			{Account: UserAccount(userId), Amount: amount},
+			{Account: HouseAccount, Amount: -amount},
+		},
+	}
+}
+
+func pair(kind string, d Data, amount Money) JournalEntry {
+	return JournalEntry{
+		Kind:      kind,
+		DataId:    d.ID,
+		CreatedAt: time.Now(),
+		Postings: []Posting{
+			{Account: UserAccount(d.UserId), Amount: amount},
+			{Account: d.Counterparty(), Amount: -amount},
+		},
+	}
+}
+
+// sum of postings is 0
+func (e JournalEntry) Balanced() bool {
+	var sum Money
+	for _, p := range e.Postings {
+		sum += p.Amount
+	}
+
+	return sum == 0
+}
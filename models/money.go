@@ -0,0 +1,170 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount stored as integer minor units (cents).
+// float64 was used before and reconciled totals drifted after thousands of operations.
+type Money int64
+
+const (
+	// number of digits after decimal point. 2 --> cents
+	MoneyScale = 2
+
+	// minor units in one major unit. must be 10^MoneyScale
+	moneyUnit = 100
+
+	// postgres column type for all amounts and balances
+	MoneyColumn = "numeric(20,2)"
+)
+
+// strict parsing of amount received from providers
+// only plain decimal notation accepted: "10", "10.1", "10.15"
+// negative values, more than two decimals, NaN/Inf, exponent notation,
+// thousands separators and signs are rejected
+func ParseMoney(s string) (Money, error) {
+
+	if s == "" {
+		return 0, fmt.Errorf("amount cant be null")
+	}
+
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+		if frac == "" {
+			return 0, fmt.Errorf("wrong amount format")
+		}
+	}
+
+	if whole == "" || !digitsOnly(whole) || !digitsOnly(frac) {
+		return 0, fmt.Errorf("wrong amount format")
+	}
+
+	if len(frac) > MoneyScale {
+		return 0, fmt.Errorf("amount can't have more than %d decimals", MoneyScale)
+	}
+
+	w, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || w > math.MaxInt64/moneyUnit-1 {
+		return 0, fmt.Errorf("amount is too big")
+	}
+
+	for len(frac) < MoneyScale {
+		frac += "0"
+	}
+
+	f, _ := strconv.ParseInt(frac, 10, 64)
+
+	return Money(w*moneyUnit + f), nil
+}
+
+func digitsOnly(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decimal representation with exactly two decimals. Example: "10.15", "-0.50"
+func (m Money) String() string {
+	sign := ""
+	u := uint64(m)
+	if m < 0 {
+		sign = "-"
+		u = uint64(-m)
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, u/moneyUnit, u%moneyUnit)
+}
+
+// amounts are sent to clients as strings the same way they are received
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// json of api requests parsed strict same as ParseMoney. negative amounts rejected
+func (m *Money) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+
+	*m = v
+	return nil
+}
+
+// saved to numeric column as decimal text. no float conversion
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// read from numeric column
+func (m *Money) Scan(src interface{}) error {
+
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+	case []byte:
+		return m.scanSigned(string(v))
+	case string:
+		return m.scanSigned(v)
+	case int64:
+		*m = Money(v * moneyUnit)
+	case float64:
+		// old float columns before migration
+		*m = Money(math.Round(v * moneyUnit))
+	default:
+		return fmt.Errorf("can't scan %T into Money", src)
+	}
+
+	return nil
+}
+
+func (m *Money) scanSigned(s string) error {
+	v, err := ParseSignedMoney(s)
+	if err != nil {
+		return err
+	}
+
+	*m = v
+	return nil
+}
+
+// amounts written by service itself: database values and write-ahead log
+// can be negative and can have trailing zeros ("10.1500")
+func ParseSignedMoney(s string) (Money, error) {
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	if i := strings.IndexByte(s, '.'); i >= 0 && len(s)-i-1 > MoneyScale {
+		if strings.Trim(s[i+1+MoneyScale:], "0") != "" {
+			return 0, fmt.Errorf("database amount %s has more than %d decimals", s, MoneyScale)
+		}
+		s = s[:i+1+MoneyScale]
+	}
+
+	v, err := ParseMoney(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if neg {
+		v = -v
+	}
+
+	return v, nil
+}
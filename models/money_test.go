@@ -0,0 +1,117 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+
+	valid := map[string]Money{
+		"0":        0,
+		"10":       1000,
+		"10.1":     1010,
+		"10.15":    1015,
+		"0.01":     1,
+		"007.50":   750,
+		"27.99":    2799,
+		"12345678": 1234567800,
+	}
+
+	for s, want := range valid {
+		got, err := ParseMoney(s)
+		if err != nil {
+			t.Errorf("ParseMoney(%q) unexpected error: %v", s, err)
+			continue
+		}
+
+		if got != want {
+			t.Errorf("ParseMoney(%q) = %d, want %d", s, got, want)
+		}
+	}
+
+	invalid := []string{
+		"", "-10.15", "+10.15", "10.155", "10.", ".15", "1e3", "1E3", "NaN", "Inf", "-Inf",
+		"3,148.19", " 10.15", "10.15 ", "0x10", "99999999999999999999",
+	}
+
+	for _, s := range invalid {
+		if _, err := ParseMoney(s); err == nil {
+			t.Errorf("ParseMoney(%q) expected error", s)
+		}
+	}
+}
+
+func TestMoney_String(t *testing.T) {
+
+	cases := map[Money]string{
+		0:     "0.00",
+		1:     "0.01",
+		1015:  "10.15",
+		-50:   "-0.50",
+		-1015: "-10.15",
+	}
+
+	for m, want := range cases {
+		if got := m.String(); got != want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(m), got, want)
+		}
+	}
+}
+
+func TestMoney_Scan(t *testing.T) {
+
+	cases := []struct {
+		src  interface{}
+		want Money
+	}{
+		{[]byte("10.15"), 1015},
+		{"-3.10", -310},
+		{"7.5000", 750},
+		{int64(3), 300},
+		{float64(0.1 + 0.2), 30},
+	}
+
+	for _, c := range cases {
+		var m Money
+		if err := m.Scan(c.src); err != nil {
+			t.Errorf("Scan(%v) unexpected error: %v", c.src, err)
+			continue
+		}
+
+		if m != c.want {
+			t.Errorf("Scan(%v) = %d, want %d", c.src, m, c.want)
+		}
+	}
+
+	var m Money
+	if err := m.Scan("1.005"); err == nil {
+		t.Errorf("Scan(1.005) expected error")
+	}
+}
+
+func TestMoney_JSON(t *testing.T) {
+
+	b, err := json.Marshal(Money(1015))
+	if err != nil || string(b) != `"10.15"` {
+		t.Fatalf("Marshal = %s, %v", b, err)
+	}
+
+	var m Money
+	if err := json.Unmarshal([]byte(`"27.99"`), &m); err != nil || m != 2799 {
+		t.Fatalf("Unmarshal = %d, %v", m, err)
+	}
+
+	if err := json.Unmarshal([]byte(`"1e2"`), &m); err == nil {
+		t.Fatalf("Unmarshal exponent expected error")
+	}
+
+	// api input. negative amounts rejected, allowed only with ParseSignedMoney
+	if err := json.Unmarshal([]byte(`"-5.00"`), &m); err == nil {
+		t.Fatalf("Unmarshal negative expected error")
+	}
+
+	if v, err := ParseSignedMoney("-5.00"); err != nil || v != -500 {
+		t.Fatalf("ParseSignedMoney = %d, %v", v, err)
+	}
+}
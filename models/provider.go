@@ -0,0 +1,126 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+type (
+	// 3rd-party provider sending transactions
+	// api key saved only as hash. plain key shown once after create or rotate
+	Provider struct {
+		gorm.Model
+		Name        string     `gorm:"unique_index"`
+		KeyPrefix   string     // first characters of api key. for identification in lists
+		KeyHash     string     `gorm:"unique_index" json:"-"`
+		SourceTypes string     // allowed source types. comma separated names
+		RevokedAt   *time.Time // not nil --> api key revoked
+
+		// shared secret for HMAC-SHA256 request signing. empty --> requests not signed
+		// saved as plain text. needed for signature check
+		HmacSecret string `json:"-"`
+		Signed     bool   `gorm:"-" json:"signed"`
+	}
+
+	// create provider request
+	ProviderData struct {
+		Name        string   `json:"name"`
+		SourceTypes []string `json:"sourceTypes"`
+		Signed      bool     `json:"signed"` // true --> hmac secret generated. requests must be signed
+	}
+
+	// provider with plain api key and hmac secret. returned only after create, rotate or new secret
+	ProviderKey struct {
+		Provider   Provider `json:"provider"`
+		ApiKey     string   `json:"apiKey,omitempty"`
+		HmacSecret string   `json:"hmacSecret,omitempty"`
+	}
+)
+
+const keyPrefixLength = 11 // "pk_" + 8 characters
+
+// new random api key and its hash
+func NewApiKey() (key, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	key = "pk_" + hex.EncodeToString(b)
+	return key, HashApiKey(key), nil
+}
+
+// api keys are random. sha256 is enough, no need for slow hash
+func HashApiKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// set new api key. returns plain key
+func (p *Provider) Rotate() (string, error) {
+	key, hash, err := NewApiKey()
+	if err != nil {
+		return "", err
+	}
+
+	p.KeyHash = hash
+	p.KeyPrefix = key[:keyPrefixLength]
+	p.RevokedAt = nil
+
+	return key, nil
+}
+
+// set new hmac secret. returns secret
+func (p *Provider) NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	p.HmacSecret = hex.EncodeToString(b)
+	p.Signed = true
+
+	return p.HmacSecret, nil
+}
+
+// requests of provider not signed anymore
+func (p *Provider) RemoveSecret() {
+	p.HmacSecret = ""
+	p.Signed = false
+}
+
+// gorm callback. signed shown in responses without secret
+func (p *Provider) AfterFind() error {
+	p.Signed = p.HmacSecret != ""
+	return nil
+}
+
+// hex encoded HMAC-SHA256 of timestamp and request body joined with "."
+func Signature(secret, timestamp string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(timestamp))
+	m.Write([]byte("."))
+	m.Write(body)
+
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func (p Provider) Revoked() bool {
+	return p.RevokedAt != nil
+}
+
+// check if provider allowed to send transactions with source type
+func (p Provider) AllowsSource(name string) bool {
+	for _, v := range strings.Split(p.SourceTypes, ",") {
+		if v == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+type (
+	// balance of user recomputed from transaction records. same database snapshot as users.balance
+	BalanceCheck struct {
+		UserId   string
+		Balance  Money // users.balance
+		Expected Money // opening balance + processed records - applied cancellations
+	}
+
+	// user with balance different from recomputed balance
+	Discrepancy struct {
+		UserId   string `json:"userId"`
+		Expected Money  `json:"expected"`        // recomputed from transaction records
+		Database Money  `json:"database"`        // users.balance
+		Cache    *Money `json:"cache,omitempty"` // in-memory balance. nil --> not loaded by this instance
+
+		// transactions or cancels of user not saved to database or cache balance not saved yet
+		// difference can be temporary. not repaired
+		Pending bool `json:"pending"`
+
+		Repaired bool `json:"repaired"` // database and cache balance set to expected
+	}
+
+	ReconcileReport struct {
+		Time          time.Time     `json:"time"`
+		Users         int           `json:"users"` // checked users
+		Repair        bool          `json:"repair"`
+		Discrepancies []Discrepancy `json:"discrepancies"`
+	}
+)
+
+// one row per discrepancy. empty cache --> not loaded
+func (r ReconcileReport) WriteCSV(w io.Writer) error {
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"userId", "expected", "database", "cache", "pending", "repaired"}); err != nil {
+		return err
+	}
+
+	for _, d := range r.Discrepancies {
+		cache := ""
+		if d.Cache != nil {
+			cache = d.Cache.String()
+		}
+
+		row := []string{d.UserId, d.Expected.String(), d.Database.String(), cache, strconv.FormatBool(d.Pending), strconv.FormatBool(d.Repaired)}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type (
+	// source type of requests. id saved in data.source
+	// ids never changed or reused. disabled source types kept for old transactions
+	SourceType struct {
+		ID        int    `gorm:"primary_key;auto_increment:false"`
+		Name      string `gorm:"unique_index"`
+		Enabled   bool
+		CreatedAt time.Time
+
+		Rules SourceRules `gorm:"embedded"`
+	}
+
+	// business rules of source type. zero value --> no restrictions
+	SourceRules struct {
+		States        string `gorm:"not null;default:''" json:"states"`                      // allowed states comma separated. empty --> win and lose
+		MinAmount     Money  `gorm:"type:numeric(20,2);not null;default:0" json:"minAmount"` // minimum amount of transaction. 0 --> no limit
+		MaxAmount     Money  `gorm:"type:numeric(20,2);not null;default:0" json:"maxAmount"` // maximum amount of transaction. 0 --> no limit
+		NotCancelable bool   `gorm:"not null;default:false" json:"notCancelable"`            // true --> never canceled by post processing
+		AllowNegative bool   `gorm:"not null;default:false" json:"allowNegative"`            // true --> user balance can be negative after transaction or cancel
+	}
+
+	// create or update source type request
+	SourceTypeData struct {
+		Name    string       `json:"name"`
+		Enabled *bool        `json:"enabled"` // default true for new source type
+		Rules   *SourceRules `json:"rules"`   // nil --> not changed. no restrictions for new source type
+	}
+)
+
+// source types before registry. ids same as saved in existing transaction records
+var DefaultSourceTypes = []SourceType{
+	{ID: 0, Name: "game", Enabled: true},
+	{ID: 1, Name: "server", Enabled: true},
+	{ID: 2, Name: "payment", Enabled: true},
+}
+
+// check rules. state --> win / lose
+func (r SourceRules) Validate() error {
+
+	for _, v := range strings.Split(r.States, ",") {
+		if r.States != "" && v != "win" && v != "lose" {
+			return fmt.Errorf("wrong state %q in rules", v)
+		}
+	}
+
+	if r.MinAmount < 0 || r.MaxAmount < 0 || (r.MaxAmount > 0 && r.MinAmount > r.MaxAmount) {
+		return fmt.Errorf("wrong amount limits in rules")
+	}
+
+	return nil
+}
+
+// check request of source type. state and amount must be valid
+func (r SourceRules) Check(state string, amount Money) error {
+
+	if r.States != "" {
+		allowed := false
+		for _, v := range strings.Split(r.States, ",") {
+			allowed = allowed || v == state
+		}
+
+		if !allowed {
+			return fmt.Errorf("state %s not allowed for source type", state)
+		}
+	}
+
+	if r.MinAmount > 0 && amount < r.MinAmount {
+		return fmt.Errorf("amount less than minimum %s", r.MinAmount)
+	}
+
+	if r.MaxAmount > 0 && amount > r.MaxAmount {
+		return fmt.Errorf("amount more than maximum %s", r.MaxAmount)
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"math/big"
+	"sort"
+)
+
+// batches from this size copied with COPY. smaller batches inserted with multi row insert
+// multi row insert is limited by 65535 parameters of postgres
+const CopyMinRows = 1000
+
+var dataColumns = []string{"id", "created_at", "updated_at", "deleted_at", "user_id", "state", "status", "source", "provider_id", "amount", "transaction_id", "balance", "request_hash", "code", "message"}
+
+// pgx connections for COPY. gorm driver doesn't support it
+func NewCopyPool(configuration string) (*pgxpool.Pool, error) {
+	return pgxpool.New(context.Background(), configuration)
+}
+
+// records and journal entries of batch copied in one database transaction
+func (r *TaskRepository) copyTransactions(transactions []models.Data) error {
+
+	ctx := context.Background()
+	tx, err := r.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// no effect after commit
+	defer tx.Rollback(ctx)
+
+	ids, err := copyIds(ctx, tx, "data", len(transactions))
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]interface{}, 0, len(transactions))
+	var entries []models.JournalEntry
+	for k, d := range transactions {
+		d.ID = ids[k]
+		if d.Status == models.StatusProcessed {
+			entries = append(entries, models.TransactionEntry(d))
+		}
+
+		rows = append(rows, []interface{}{d.ID, d.CreatedAt, d.UpdatedAt, d.DeletedAt, d.UserId, d.State, d.Status, d.Source, d.ProviderId,
+			numeric(d.Amount), d.TransactionId, numeric(d.Balance), d.RequestHash, d.Code, d.Message})
+	}
+
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"data"}, dataColumns, pgx.CopyFromRows(rows)); err != nil {
+		return err
+	}
+
+	if err := copyEntries(ctx, tx, entries); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// same as postEntries with COPY
+func copyEntries(ctx context.Context, tx pgx.Tx, entries []models.JournalEntry) error {
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	ids, err := copyIds(ctx, tx, "journal_entries", len(entries))
+	if err != nil {
+		return err
+	}
+
+	accounts := make(map[string]bool)
+	var entryRows, postingRows [][]interface{}
+	for k := range entries {
+		e := &entries[k]
+		if !e.Balanced() {
+			return fmt.Errorf("journal entry %s of record %d not balanced", e.Kind, e.DataId)
+		}
+
+		e.ID = ids[k]
+		entryRows = append(entryRows, []interface{}{e.ID, e.Kind, e.DataId, e.CancellationId, e.CreatedAt})
+
+		for _, p := range e.Postings {
+			postingRows = append(postingRows, []interface{}{e.ID, p.Account, numeric(p.Amount)})
+			accounts[p.Account] = true
+		}
+	}
+
+	// sorted. concurrent database transactions lock accounts in same order
+	codes := make([]string, 0, len(accounts))
+	for code := range accounts {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	kinds := make([]string, 0, len(codes))
+	for _, code := range codes {
+		kinds = append(kinds, models.AccountKind(code))
+	}
+
+	_, err = tx.Exec(ctx, "INSERT INTO accounts (code, kind, created_at) SELECT code, kind, now() FROM unnest($1::text[], $2::text[]) AS a(code, kind) ON CONFLICT (code) DO NOTHING", codes, kinds)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"journal_entries"}, []string{"id", "kind", "data_id", "cancellation_id", "created_at"}, pgx.CopyFromRows(entryRows)); err != nil {
+		return err
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"postings"}, []string{"entry_id", "account", "amount"}, pgx.CopyFromRows(postingRows))
+	return err
+}
+
+// same as nextIds with pgx
+func copyIds(ctx context.Context, tx pgx.Tx, table string, n int) ([]uint, error) {
+
+	rows, err := tx.Query(ctx, "SELECT nextval(pg_get_serial_sequence($1, 'id')) FROM generate_series(1, $2)", table, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]uint, 0, n)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, uint(id))
+	}
+
+	return ids, rows.Err()
+}
+
+// binary COPY needs numeric value. cents with exponent -2
+func numeric(m models.Money) pgtype.Numeric {
+	return pgtype.Numeric{Int: big.NewInt(int64(m)), Exp: -models.MoneyScale, Valid: true}
+}
@@ -1,7 +1,10 @@
 package service
 
 import (
+	"database/sql"
+	"fmt"
 	"github.com/SaCavid/simple-task/models"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"log"
@@ -11,19 +14,28 @@ import (
 
 type TaskRepository struct {
 	Db *gorm.DB
+
+	// COPY of large transaction batches. nil --> multi row insert only
+	Pool *pgxpool.Pool
 }
 
-func NewTaskRepository(configuration string) *TaskRepository {
+// postgres implementation of Repository
+func NewTaskRepository(configuration string) (*TaskRepository, error) {
 
 	// docker-compose sometimes starts processing container faster than expected.
 	// timeout for not to get error. docker-compose depends on configuration didnt helps. can be adjusted.
 	time.Sleep(5 * time.Second)
 	taskRepo, err := CreateDbConnection(configuration)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	pool, err := NewCopyPool(configuration)
+	if err != nil {
+		return nil, err
 	}
 
-	return &TaskRepository{Db: taskRepo}
+	return &TaskRepository{Db: taskRepo, Pool: pool}, nil
 }
 
 func CreateDbConnection(connectionUri string) (*gorm.DB, error) {
@@ -33,15 +45,79 @@ func CreateDbConnection(connectionUri string) (*gorm.DB, error) {
 		return nil, err
 	}
 
-	db.AutoMigrate(&models.Data{}, &models.User{})
+	db.AutoMigrate(&models.Data{}, &models.User{}, &models.Provider{}, &models.SourceType{}, &models.Cancellation{},
+		&models.Account{}, &models.JournalEntry{}, &models.Posting{}, &models.DeadLetter{})
+
+	// amounts were float columns before. AutoMigrate doesn't change existing column types
+	if err := migrateMoneyColumns(db); err != nil {
+		return nil, err
+	}
+
+	// user transaction history. keyset pagination over id
+	err = db.Exec("CREATE INDEX IF NOT EXISTS idx_data_user_id_id ON data (user_id, id DESC)").Error
+	if err != nil {
+		return nil, err
+	}
+
+	// transaction id used only once. empty ids of old error records excluded
+	err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS " + TransactionIdIndex + " ON data (transaction_id) WHERE transaction_id <> ''").Error
+	if err != nil {
+		return nil, fmt.Errorf("unique transaction id constraint: %v. duplicated transaction ids must be removed from data table", err)
+	}
+
+	// source types used before registry. existing transaction records keep same ids
+	for _, v := range models.DefaultSourceTypes {
+		err = db.Exec("INSERT INTO source_types (id, name, enabled, created_at) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING", v.ID, v.Name, v.Enabled, time.Now()).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// ledger accounts of users registered before ledger
+	if err := openLedger(db); err != nil {
+		return nil, err
+	}
 
 	// while development can be triggered to drop database tables
 	// can be changed in .env file
 	b := os.Getenv("DROP_TABLES")
 	if b == "true" {
-		log.Println("Dropping tables data and users")
-		db.DropTableIfExists(&models.Data{}, &models.User{})
+		log.Println("Dropping tables data, users and ledger")
+		db.DropTableIfExists(&models.Data{}, &models.User{}, &models.Account{}, &models.JournalEntry{}, &models.Posting{})
 	}
 
 	return db, nil
 }
+
+// convert balance and amount columns to exact numeric type
+// ALTER COLUMN TYPE rewrites whole table. columns already numeric with money scale not changed
+func migrateMoneyColumns(db *gorm.DB) error {
+
+	columns := [][2]string{
+		{"users", "balance"},
+		{"data", "amount"},
+		{"data", "balance"},
+	}
+
+	for _, c := range columns {
+		table, column := c[0], c[1]
+
+		var dataType string
+		var scale sql.NullInt64
+		err := db.Raw("SELECT data_type, numeric_scale FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?", table, column).Row().Scan(&dataType, &scale)
+		if err != nil {
+			return err
+		}
+
+		if dataType == "numeric" && scale.Valid && scale.Int64 == models.MoneyScale {
+			continue
+		}
+
+		stmt := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s USING round(%s::numeric, %d)", table, column, models.MoneyColumn, column, models.MoneyScale)
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
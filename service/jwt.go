@@ -0,0 +1,139 @@
+package service
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"io/ioutil"
+	"math/big"
+	"time"
+)
+
+// claims of bearer token. subject --> user id for user role, provider id for provider role
+type Claims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// JWTVerifier checks HS256 tokens with shared secret and RS256 tokens with public keys of local JWKS file
+type JWTVerifier struct {
+	secret []byte
+	keys   map[string]*rsa.PublicKey // by key id
+}
+
+// json web key set file. only RSA keys used
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+var ErrTokenExpiration = errors.New("token must have expiration time")
+
+// empty secret --> HS256 disabled. empty path --> RS256 disabled
+func NewJWTVerifier(secret, jwksPath string) (*JWTVerifier, error) {
+
+	v := &JWTVerifier{secret: []byte(secret), keys: make(map[string]*rsa.PublicKey)}
+	if jwksPath == "" {
+		return v, nil
+	}
+
+	b, err := ioutil.ReadFile(jwksPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var set jwks
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("jwks %s: %v", jwksPath, err)
+	}
+
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %s: %v", k.Kid, err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %s: %v", k.Kid, err)
+		}
+
+		v.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	return v, nil
+}
+
+// verify signature, expiration and algorithm of token
+// HS256 token never checked with RSA key and RS256 token never checked with secret
+func (v *JWTVerifier) Verify(token string) (*Claims, error) {
+
+	claims := new(Claims)
+	_, err := jwt.ParseWithClaims(token, claims, v.key, jwt.WithValidMethods([]string{"HS256", "RS256"}))
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt == nil {
+		return nil, ErrTokenExpiration
+	}
+
+	return claims, nil
+}
+
+// HS256 token with role and subject. expires after ttl
+func SignToken(secret, role, subject string, ttl time.Duration) (string, error) {
+
+	if secret == "" {
+		return "", fmt.Errorf("secret of HS256 tokens required")
+	}
+
+	now := time.Now()
+	claims := Claims{Role: role, RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   subject,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+}
+
+func (v *JWTVerifier) key(t *jwt.Token) (interface{}, error) {
+
+	switch t.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(v.secret) == 0 {
+			return nil, fmt.Errorf("HS256 tokens not accepted")
+		}
+		return v.secret, nil
+
+	case *jwt.SigningMethodRSA:
+		kid, _ := t.Header["kid"].(string)
+		if k, ok := v.keys[kid]; ok {
+			return k, nil
+		}
+
+		// token without key id accepted if there is only one key
+		if kid == "" && len(v.keys) == 1 {
+			for _, k := range v.keys {
+				return k, nil
+			}
+		}
+
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJWTVerifier(t *testing.T) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "key-1",
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+
+	b, _ := json.Marshal(set)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := NewJWTVerifier("secret", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := Claims{Role: "user", RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   "user-1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}
+
+	sign := func(method jwt.SigningMethod, kid string, claims Claims, key interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	noExpiration := claims
+	noExpiration.ExpiresAt = nil
+
+	// public key of jwks used as HS256 secret. algorithm confusion
+	publicAsSecret := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+
+	cases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"rs256", sign(jwt.SigningMethodRS256, "key-1", claims, key), true},
+		{"rs256 without kid", sign(jwt.SigningMethodRS256, "", claims, key), true},
+		{"hs256", sign(jwt.SigningMethodHS256, "", claims, []byte("secret")), true},
+		{"unknown kid", sign(jwt.SigningMethodRS256, "key-2", claims, key), false},
+		{"other key", sign(jwt.SigningMethodRS256, "key-1", claims, other), false},
+		{"rs512", sign(jwt.SigningMethodRS512, "key-1", claims, key), false},
+		{"wrong secret", sign(jwt.SigningMethodHS256, "", claims, []byte("wrong")), false},
+		{"public key as secret", sign(jwt.SigningMethodHS256, "key-1", claims, []byte(publicAsSecret)), false},
+		{"no expiration", sign(jwt.SigningMethodHS256, "", noExpiration, []byte("secret")), false},
+	}
+
+	for _, c := range cases {
+		res, err := v.Verify(c.token)
+		if c.valid && (err != nil || res.Subject != "user-1" || res.Role != "user") {
+			t.Fatalf("%s: expected valid token, got %v %+v", c.name, err, res)
+		}
+
+		if !c.valid && err == nil {
+			t.Fatalf("%s: expected error", c.name)
+		}
+	}
+
+	// HS256 disabled without secret
+	v, _ = NewJWTVerifier("", path)
+	if _, err := v.Verify(sign(jwt.SigningMethodHS256, "", claims, []byte(""))); err == nil {
+		t.Fatal("expected error for HS256 token without secret")
+	}
+}
+
+func TestSignToken(t *testing.T) {
+
+	token, err := SignToken("secret", "admin", "operator", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ := NewJWTVerifier("secret", "")
+	claims, err := v.Verify(token)
+	if err != nil || claims.Role != "admin" || claims.Subject != "operator" {
+		t.Fatalf("expected admin token of operator, got %v %+v", err, claims)
+	}
+
+	if _, err := SignToken("", "admin", "operator", time.Hour); err == nil {
+		t.Fatal("expected error without secret")
+	}
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/jinzhu/gorm"
+	"hash/fnv"
+	"sync"
+)
+
+// Lock is held by one instance at same time. used for leader election of singleton jobs
+type Lock interface {
+	TryAcquire(ctx context.Context) (bool, error) // true --> lock held by this instance
+	Held(ctx context.Context) error               // nil --> lock still held
+	Release() error
+}
+
+var ErrLockLost = errors.New("lock lost")
+
+// postgres session advisory lock. lock belongs to one database connection
+// released by postgres when connection closed, so other instance takes it when leader stops or its connection lost
+// used by one goroutine
+type AdvisoryLock struct {
+	db   *sql.DB
+	key  int64
+	conn *sql.Conn // connection holding lock. nil --> not held
+}
+
+// lock key from name. all instances must use same name
+func NewAdvisoryLock(db *gorm.DB, name string) *AdvisoryLock {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+
+	return &AdvisoryLock{db: db.DB(), key: int64(h.Sum64())}
+}
+
+func (l *AdvisoryLock) TryAcquire(ctx context.Context) (bool, error) {
+	if l.conn != nil {
+		return true, nil
+	}
+
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var ok bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&ok); err != nil {
+		conn.Close()
+		return false, err
+	}
+
+	// held by other instance. connection returned to pool
+	if !ok {
+		conn.Close()
+		return false, nil
+	}
+
+	l.conn = conn
+	return true, nil
+}
+
+// session lock held while connection alive
+func (l *AdvisoryLock) Held(ctx context.Context) error {
+	if l.conn == nil {
+		return ErrLockLost
+	}
+
+	if err := l.conn.PingContext(ctx); err != nil {
+		l.conn.Close()
+		l.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+func (l *AdvisoryLock) Release() error {
+	if l.conn == nil {
+		return nil
+	}
+
+	_, err := l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", l.key)
+
+	// closed connection releases lock too
+	l.conn.Close()
+	l.conn = nil
+	return err
+}
+
+// in-process lock shared by servers of same process. used for testing leader election without postgres
+type MemoryLock struct {
+	mu     sync.Mutex
+	holder *MemoryLockHandle
+}
+
+// lock of one server
+type MemoryLockHandle struct {
+	lock *MemoryLock
+}
+
+func (l *MemoryLock) Handle() *MemoryLockHandle {
+	return &MemoryLockHandle{lock: l}
+}
+
+func (m *MemoryLockHandle) TryAcquire(ctx context.Context) (bool, error) {
+	m.lock.mu.Lock()
+	defer m.lock.mu.Unlock()
+
+	if m.lock.holder == nil {
+		m.lock.holder = m
+	}
+
+	return m.lock.holder == m, nil
+}
+
+func (m *MemoryLockHandle) Held(ctx context.Context) error {
+	m.lock.mu.Lock()
+	defer m.lock.mu.Unlock()
+
+	if m.lock.holder != m {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+func (m *MemoryLockHandle) Release() error {
+	m.lock.mu.Lock()
+	defer m.lock.mu.Unlock()
+
+	if m.lock.holder == m {
+		m.lock.holder = nil
+	}
+
+	return nil
+}
+
+// lock taken from holder. same as lost database connection of leader
+func (l *MemoryLock) Break() {
+	l.mu.Lock()
+	l.holder = nil
+	l.mu.Unlock()
+}
@@ -0,0 +1,296 @@
+package service
+
+import (
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/jinzhu/gorm"
+	"sort"
+	"strings"
+)
+
+// insert journal entries with postings in one multi row insert per table
+// missing accounts created. must be called in database transaction
+func postEntries(tx *gorm.DB, entries []models.JournalEntry) error {
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	ids, err := nextIds(tx, "journal_entries", len(entries))
+	if err != nil {
+		return err
+	}
+
+	accounts := make(map[string]bool)
+	var entryValue, postingValue []string
+	var entryValues, postingValues []interface{}
+	for k := range entries {
+		e := &entries[k]
+		if !e.Balanced() {
+			return fmt.Errorf("journal entry %s of record %d not balanced", e.Kind, e.DataId)
+		}
+
+		e.ID = ids[k]
+		entryValue = append(entryValue, "(?,?,?,?,?)")
+		entryValues = append(entryValues, e.ID, e.Kind, e.DataId, e.CancellationId, e.CreatedAt)
+
+		for _, p := range e.Postings {
+			postingValue = append(postingValue, "(?,?,?)")
+			postingValues = append(postingValues, e.ID, p.Account, p.Amount)
+			accounts[p.Account] = true
+		}
+	}
+
+	codes := make([]string, 0, len(accounts))
+	for code := range accounts {
+		codes = append(codes, code)
+	}
+
+	if err := ensureAccounts(tx, codes); err != nil {
+		return err
+	}
+
+	stmt := fmt.Sprintf("INSERT INTO journal_entries (id, kind, data_id, cancellation_id, created_at) VALUES %s", strings.Join(entryValue, ","))
+	if err := tx.Exec(stmt, entryValues...).Error; err != nil {
+		return err
+	}
+
+	stmt = fmt.Sprintf("INSERT INTO postings (entry_id, account, amount) VALUES %s", strings.Join(postingValue, ","))
+	return tx.Exec(stmt, postingValues...).Error
+}
+
+// create accounts if not exist. sorted so concurrent database transactions lock accounts in same order
+func ensureAccounts(tx *gorm.DB, codes []string) error {
+
+	sort.Strings(codes)
+
+	var value []string
+	var values []interface{}
+	for _, code := range codes {
+		value = append(value, "(?,?,now())")
+		values = append(values, code, models.AccountKind(code))
+	}
+
+	stmt := fmt.Sprintf("INSERT INTO accounts (code, kind, created_at) VALUES %s ON CONFLICT (code) DO NOTHING", strings.Join(value, ","))
+	return tx.Exec(stmt, values...).Error
+}
+
+// n ids from serial sequence of table. rows inserted with known ids in multi row insert
+func nextIds(tx *gorm.DB, table string, n int) ([]uint, error) {
+
+	rows, err := tx.Raw("SELECT nextval(pg_get_serial_sequence(?, 'id')) FROM generate_series(1, ?)", table, n).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]uint, 0, n)
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// ledger history of users registered before ledger
+func openLedger(db *gorm.DB) error {
+
+	var users []models.User
+	err := db.Where("NOT EXISTS (SELECT 1 FROM accounts WHERE code = ?::text || users.user_id)", models.AccountUser+":").Find(&users).Error
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		tx := db.Begin()
+		if tx.Error != nil {
+			return tx.Error
+		}
+
+		if err := backfillAccount(tx, u); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// records and applied cancellations of user posted with their own time
+// part of users.balance not explained by records posted as opening entry. balance recomputed from records same as ledger
+func backfillAccount(tx *gorm.DB, u models.User) error {
+
+	var data []models.Data
+	err := tx.Where("user_id = ? AND status IN (?)", u.UserId, []uint8{models.StatusProcessed, models.StatusCanceled, models.StatusCancelDenied}).Order("id").Find(&data).Error
+	if err != nil {
+		return err
+	}
+
+	applied := make(map[uint]models.Cancellation)
+	var ids []uint
+	for _, d := range data {
+		if d.Status == models.StatusCanceled {
+			ids = append(ids, d.ID)
+		}
+	}
+
+	if len(ids) > 0 {
+		var cancels []models.Cancellation
+		if err := tx.Where("data_id IN (?) AND outcome = ?", ids, models.CancelApplied).Find(&cancels).Error; err != nil {
+			return err
+		}
+
+		for _, c := range cancels {
+			applied[c.DataId] = c
+		}
+	}
+
+	opening := u.Balance
+	entries := make([]models.JournalEntry, 0, len(data)+len(ids))
+	for _, d := range data {
+		e := models.TransactionEntry(d)
+		e.CreatedAt = d.CreatedAt
+		entries = append(entries, e)
+		opening -= d.Delta()
+
+		if d.Status != models.StatusCanceled {
+			continue
+		}
+
+		// canceled before audit rows --> full amount
+		c, ok := applied[d.ID]
+		e = models.CancelEntry(d, c)
+		e.CreatedAt = c.CreatedAt
+		if !ok {
+			e.CreatedAt = d.UpdatedAt
+		}
+		entries = append(entries, e)
+		opening += c.Delta(d)
+	}
+
+	u.Balance = opening
+	if err := openAccount(tx, u); err != nil {
+		return err
+	}
+
+	// maximum 1000 entries per insert. parameters limit of postgres
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > 1000 {
+			n = 1000
+		}
+
+		if err := postEntries(tx, entries[:n]); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+
+	return nil
+}
+
+// account of new user. opening entry if user has balance
+func openAccount(tx *gorm.DB, u models.User) error {
+	if u.Balance == 0 {
+		return ensureAccounts(tx, []string{models.UserAccount(u.UserId)})
+	}
+
+	return postEntries(tx, []models.JournalEntry{models.OpeningEntry(u)})
+}
+
+// sum of user account postings
+func ledgerBalance(tx *gorm.DB, userId string) (models.Money, error) {
+	var ledger struct {
+		Amount models.Money
+	}
+
+	err := tx.Raw("SELECT COALESCE(SUM(amount), 0) AS amount FROM postings WHERE account = ?", models.UserAccount(userId)).Scan(&ledger).Error
+	return ledger.Amount, err
+}
+
+// users.balance is projection of user account. checked in database transaction of every balance write
+func checkProjection(tx *gorm.DB, userId string, balance models.Money) error {
+
+	ledger, err := ledgerBalance(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	if ledger != balance {
+		return fmt.Errorf("%w: user %s balance %s ledger %s", ErrLedgerMismatch, userId, balance, ledger)
+	}
+
+	return nil
+}
+
+// postings of user account with running balance. oldest first
+func (r *TaskRepository) UserLedger(userId string) ([]models.LedgerLine, error) {
+	lines := make([]models.LedgerLine, 0)
+
+	err := r.Db.Raw("SELECT e.id AS entry_id, e.kind, e.data_id, e.cancellation_id, p.amount, e.created_at FROM postings p JOIN journal_entries e ON e.id = p.entry_id WHERE p.account = ? ORDER BY e.id, p.id", models.UserAccount(userId)).Scan(&lines).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var balance models.Money
+	for k := range lines {
+		balance += lines[k].Amount
+		lines[k].Balance = balance
+	}
+
+	return lines, nil
+}
+
+// compare users.balance with ledger. not balanced entries listed
+func (r *TaskRepository) CheckLedger() (models.LedgerReport, error) {
+
+	report := models.LedgerReport{Unbalanced: make([]uint, 0), Users: make([]models.LedgerDiff, 0), Accounts: make(map[string]models.Money)}
+
+	if err := r.Db.Model(&models.JournalEntry{}).Count(&report.Entries).Error; err != nil {
+		return report, err
+	}
+
+	rows, err := r.Db.Raw("SELECT entry_id FROM postings GROUP BY entry_id HAVING SUM(amount) <> 0 ORDER BY entry_id").Rows()
+	if err != nil {
+		return report, err
+	}
+
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return report, err
+		}
+		report.Unbalanced = append(report.Unbalanced, id)
+	}
+	rows.Close()
+
+	err = r.Db.Raw("SELECT u.user_id, u.balance, COALESCE(SUM(p.amount), 0) AS ledger FROM users u LEFT JOIN postings p ON p.account = ?::text || u.user_id GROUP BY u.user_id, u.balance HAVING u.balance <> COALESCE(SUM(p.amount), 0) ORDER BY u.user_id", models.AccountUser+":").Scan(&report.Users).Error
+	if err != nil {
+		return report, err
+	}
+
+	var accounts []struct {
+		Account string
+		Amount  models.Money
+	}
+
+	err = r.Db.Raw("SELECT account, SUM(amount) AS amount FROM postings WHERE account NOT LIKE ? GROUP BY account", models.AccountUser+":%").Scan(&accounts).Error
+	if err != nil {
+		return report, err
+	}
+
+	for _, v := range accounts {
+		report.Accounts[v.Account] = v.Amount
+	}
+
+	return report, nil
+}
@@ -0,0 +1,680 @@
+package service
+
+import (
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// in-memory implementation of Repository
+// used for testing whole pipeline without postgres
+type MemoryRepository struct {
+	mu sync.Mutex
+
+	users     []models.User
+	data      []models.Data
+	ids       map[string]bool // unique transaction ids of data
+	providers []models.Provider
+	sources   []models.SourceType
+	cancels   []models.Cancellation
+	accounts  map[string]models.Account
+	entries   []models.JournalEntry // with postings
+	letters   []models.DeadLetter
+
+	// last used ids. same as postgres serial columns
+	userSeq     uint
+	dataSeq     uint
+	providerSeq uint
+	cancelSeq   uint
+	entrySeq    uint
+	letterSeq   uint
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	sources := make([]models.SourceType, len(models.DefaultSourceTypes))
+	copy(sources, models.DefaultSourceTypes)
+
+	return &MemoryRepository{ids: make(map[string]bool), sources: sources, accounts: make(map[string]models.Account)}
+}
+
+func (r *MemoryRepository) CreateUser(user *models.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range r.users {
+		if v.UserId == user.UserId {
+			return fmt.Errorf("user %s already exists", user.UserId)
+		}
+	}
+
+	r.userSeq++
+	user.ID = r.userSeq
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+
+	r.users = append(r.users, *user)
+
+	if user.Balance == 0 {
+		r.account(models.UserAccount(user.UserId))
+	} else {
+		r.post(models.OpeningEntry(*user))
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) FetchUsers() ([]models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	users := make([]models.User, len(r.users))
+	copy(users, r.users)
+
+	return users, nil
+}
+
+func (r *MemoryRepository) FindUser(userId string) (models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user := r.user(userId)
+	if user == nil {
+		return models.User{}, ErrUserNotFound
+	}
+
+	return *user, nil
+}
+
+func (r *MemoryRepository) CreateData(data *models.Data) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.unique(data.TransactionId); err != nil {
+		return err
+	}
+
+	r.insert(data)
+	return nil
+}
+
+// all or nothing same as database transaction
+func (r *MemoryRepository) InsertTransactions(transactions []models.Data) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make(map[string]bool, len(transactions))
+	for _, v := range transactions {
+		if err := r.unique(v.TransactionId); err != nil || ids[v.TransactionId] {
+			return fmt.Errorf("%w %s", ErrDuplicateTransaction, v.TransactionId)
+		}
+
+		if v.TransactionId != "" {
+			ids[v.TransactionId] = true
+		}
+	}
+
+	for _, v := range transactions {
+		r.insert(&v)
+		if v.Status == models.StatusProcessed {
+			r.post(models.TransactionEntry(v))
+		}
+	}
+
+	return nil
+}
+
+// same as unique index on data.transaction_id. must be called with lock
+func (r *MemoryRepository) unique(transactionId string) error {
+	if r.ids[transactionId] {
+		return fmt.Errorf("%w %s", ErrDuplicateTransaction, transactionId)
+	}
+
+	return nil
+}
+
+// must be called with lock
+func (r *MemoryRepository) insert(data *models.Data) {
+	r.dataSeq++
+	data.ID = r.dataSeq
+	if data.CreatedAt.IsZero() {
+		data.CreatedAt = time.Now()
+		data.UpdatedAt = data.CreatedAt
+	}
+
+	r.data = append(r.data, *data)
+	if data.TransactionId != "" {
+		r.ids[data.TransactionId] = true
+	}
+}
+
+func (r *MemoryRepository) FetchTransactions() ([]models.Data, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := make([]models.Data, len(r.data))
+	copy(data, r.data)
+
+	return data, nil
+}
+
+func (r *MemoryRepository) FindTransaction(transactionId string) (models.Data, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range r.data {
+		if v.TransactionId == transactionId {
+			return v, nil
+		}
+	}
+
+	return models.Data{}, ErrNotFound
+}
+
+func (r *MemoryRepository) UserTransactions(f models.TransactionFilter) ([]models.Data, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := make([]models.Data, 0)
+	for k := len(r.data) - 1; k >= 0 && len(data) < f.Limit; k-- {
+		if f.Match(r.data[k]) {
+			data = append(data, r.data[k])
+		}
+	}
+
+	return data, nil
+}
+
+// same as postgres. balances different from ledger not written
+func (r *MemoryRepository) UpdateBalances(balances []models.UserBalance) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, b := range balances {
+		user := r.user(b.UserId)
+		if user == nil || r.ledger(b.UserId) != b.Amount {
+			n++
+			continue
+		}
+
+		user.Balance = b.Amount
+		user.UpdatedAt = time.Now()
+	}
+
+	if n > 0 {
+		return fmt.Errorf("%w: %d of %d balances not written", ErrLedgerMismatch, n, len(balances))
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) SaveDeadLetter(letter *models.DeadLetter, entries ...models.JournalEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.letterSeq++
+	letter.ID = r.letterSeq
+	letter.CreatedAt = time.Now()
+
+	r.letters = append(r.letters, *letter)
+	for _, e := range entries {
+		r.post(e)
+	}
+	return nil
+}
+
+func (r *MemoryRepository) FetchDeadLetters() ([]models.DeadLetter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	letters := make([]models.DeadLetter, 0, len(r.letters))
+	for k := len(r.letters) - 1; k >= 0; k-- {
+		letters = append(letters, r.letters[k])
+	}
+
+	return letters, nil
+}
+
+// latest records of filter
+func (r *MemoryRepository) CancelCandidates(f models.CancelFilter) ([]models.Data, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data := make([]models.Data, 0)
+	for _, v := range r.data {
+		if f.Match(v) {
+			data = append(data, v)
+		}
+	}
+
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].ID > data[j].ID
+	})
+
+	if len(data) > f.Limit {
+		data = data[:f.Limit]
+	}
+
+	return data, nil
+}
+
+func (r *MemoryRepository) CancelTransaction(data *models.Data, cancel *models.Cancellation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, err := r.cancelable(data.ID)
+	if err != nil {
+		return err
+	}
+
+	d.Status = models.StatusCanceled
+	d.UpdatedAt = time.Now()
+
+	// users.balance not changed. in-memory balance with cancel saved by balance update
+	r.cancel(cancel)
+	r.post(models.CancelEntry(*data, *cancel))
+
+	data.Status = models.StatusCanceled
+	return nil
+}
+
+func (r *MemoryRepository) DenyCancel(data *models.Data, cancel *models.Cancellation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, err := r.cancelable(data.ID)
+	if err != nil {
+		return err
+	}
+
+	d.Status = models.StatusCancelDenied
+	d.UpdatedAt = time.Now()
+
+	r.cancel(cancel)
+	data.Status = models.StatusCancelDenied
+	return nil
+}
+
+func (r *MemoryRepository) FetchCancellations(dataId uint) ([]models.Cancellation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cancellations := make([]models.Cancellation, 0)
+	for _, v := range r.cancels {
+		if v.DataId == dataId {
+			cancellations = append(cancellations, v)
+		}
+	}
+
+	return cancellations, nil
+}
+
+// record not canceled yet by id. must be called with lock
+func (r *MemoryRepository) cancelable(id uint) (*models.Data, error) {
+	for k := range r.data {
+		if r.data[k].ID != id {
+			continue
+		}
+
+		if s := r.data[k].Status; s != models.StatusProcessed && s != models.StatusCancelDenied {
+			return nil, ErrAlreadyCanceled
+		}
+
+		return &r.data[k], nil
+	}
+
+	return nil, fmt.Errorf("transaction record %d not found", id)
+}
+
+// save cancellation. must be called with lock
+func (r *MemoryRepository) cancel(cancel *models.Cancellation) {
+	r.cancelSeq++
+	cancel.ID = r.cancelSeq
+	cancel.CreatedAt = time.Now()
+	cancel.UpdatedAt = cancel.CreatedAt
+
+	r.cancels = append(r.cancels, *cancel)
+}
+
+func (r *MemoryRepository) ApplyTransaction(data *models.Data) (models.Money, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user := r.user(data.UserId)
+	if user == nil {
+		return 0, ErrUserNotFound
+	}
+
+	// negative balance only with rule of source type. win for already negative balance accepted
+	balance := user.Balance + data.Delta()
+	if balance < 0 && balance < user.Balance && !data.AllowNegative {
+		return user.Balance, ErrNotEnoughBalance
+	}
+
+	if err := r.unique(data.TransactionId); err != nil {
+		return user.Balance, err
+	}
+
+	if l := r.ledger(data.UserId); l != user.Balance {
+		return user.Balance, fmt.Errorf("%w: user %s balance %s ledger %s", ErrLedgerMismatch, data.UserId, user.Balance, l)
+	}
+
+	user.Balance = balance
+	user.UpdatedAt = time.Now()
+
+	data.Status = 1
+	data.Balance = balance
+	r.insert(data)
+	r.post(models.TransactionEntry(*data))
+
+	return balance, nil
+}
+
+func (r *MemoryRepository) ApplyCancel(data *models.Data, cancel *models.Cancellation) (models.Money, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user := r.user(data.UserId)
+	if user == nil {
+		return 0, ErrUserNotFound
+	}
+
+	d, err := r.cancelable(data.ID)
+	if err != nil {
+		return user.Balance, err
+	}
+
+	d.UpdatedAt = time.Now()
+
+	// denied cancel saved too. record never selected again
+	balance := user.Balance - cancel.Delta(*data)
+	if balance < 0 && balance < user.Balance && !data.AllowNegative {
+		d.Status = models.StatusCancelDenied
+		cancel.Deny(user.Balance)
+		r.cancel(cancel)
+
+		data.Status = models.StatusCancelDenied
+		return user.Balance, ErrNotEnoughBalance
+	}
+
+	if l := r.ledger(data.UserId); l != user.Balance {
+		return user.Balance, fmt.Errorf("%w: user %s balance %s ledger %s", ErrLedgerMismatch, data.UserId, user.Balance, l)
+	}
+
+	cancel.Apply(*data, user.Balance)
+	r.cancel(cancel)
+	r.post(models.CancelEntry(*data, *cancel))
+
+	d.Status = models.StatusCanceled
+	user.Balance = balance
+	user.UpdatedAt = d.UpdatedAt
+
+	data.Status = models.StatusCanceled
+	return balance, nil
+}
+
+// save journal entry. must be called with lock
+func (r *MemoryRepository) post(e models.JournalEntry) {
+	r.entrySeq++
+	e.ID = r.entrySeq
+
+	for k := range e.Postings {
+		e.Postings[k].EntryId = e.ID
+		r.account(e.Postings[k].Account)
+	}
+
+	r.entries = append(r.entries, e)
+}
+
+// sum of user account postings. must be called with lock
+func (r *MemoryRepository) ledger(userId string) models.Money {
+	account := models.UserAccount(userId)
+
+	var balance models.Money
+	for _, e := range r.entries {
+		for _, p := range e.Postings {
+			if p.Account == account {
+				balance += p.Amount
+			}
+		}
+	}
+
+	return balance
+}
+
+// create account if not exists. must be called with lock
+func (r *MemoryRepository) account(code string) {
+	if _, ok := r.accounts[code]; !ok {
+		r.accounts[code] = models.Account{Code: code, Kind: models.AccountKind(code), CreatedAt: time.Now()}
+	}
+}
+
+func (r *MemoryRepository) UserLedger(userId string) ([]models.LedgerLine, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	account := models.UserAccount(userId)
+	lines := make([]models.LedgerLine, 0)
+
+	var balance models.Money
+	for _, e := range r.entries {
+		for _, p := range e.Postings {
+			if p.Account != account {
+				continue
+			}
+
+			balance += p.Amount
+			lines = append(lines, models.LedgerLine{EntryId: e.ID, Kind: e.Kind, DataId: e.DataId, CancellationId: e.CancellationId, Amount: p.Amount, Balance: balance, CreatedAt: e.CreatedAt})
+		}
+	}
+
+	return lines, nil
+}
+
+func (r *MemoryRepository) CheckLedger() (models.LedgerReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := models.LedgerReport{Entries: len(r.entries), Unbalanced: make([]uint, 0), Users: make([]models.LedgerDiff, 0), Accounts: make(map[string]models.Money)}
+
+	balances := make(map[string]models.Money)
+	for _, e := range r.entries {
+		if !e.Balanced() {
+			report.Unbalanced = append(report.Unbalanced, e.ID)
+		}
+
+		for _, p := range e.Postings {
+			balances[p.Account] += p.Amount
+		}
+	}
+
+	for code, b := range balances {
+		if models.AccountKind(code) != models.AccountUser {
+			report.Accounts[code] = b
+		}
+	}
+
+	for _, u := range r.users {
+		if l := balances[models.UserAccount(u.UserId)]; l != u.Balance {
+			report.Users = append(report.Users, models.LedgerDiff{UserId: u.UserId, Balance: u.Balance, Ledger: l})
+		}
+	}
+
+	sort.Slice(report.Users, func(i, j int) bool {
+		return report.Users[i].UserId < report.Users[j].UserId
+	})
+
+	return report, nil
+}
+
+// balances recomputed same way as postgres. users ordered by user id
+func (r *MemoryRepository) ReconcileBalances() ([]models.BalanceCheck, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expected := make(map[string]models.Money)
+	for _, e := range r.entries {
+		if e.Kind != models.EntryOpening {
+			continue
+		}
+
+		for _, p := range e.Postings {
+			expected[p.Account] += p.Amount
+		}
+	}
+
+	applied := make(map[uint]models.Cancellation)
+	for _, c := range r.cancels {
+		if c.Outcome == models.CancelApplied {
+			applied[c.DataId] = c
+		}
+	}
+
+	for _, d := range r.data {
+		if d.Status != models.StatusProcessed && d.Status != models.StatusCanceled && d.Status != models.StatusCancelDenied {
+			continue
+		}
+
+		account := models.UserAccount(d.UserId)
+		expected[account] += d.Delta()
+		if d.Status == models.StatusCanceled {
+			expected[account] -= applied[d.ID].Delta(d)
+		}
+	}
+
+	checks := make([]models.BalanceCheck, 0, len(r.users))
+	for _, u := range r.users {
+		checks = append(checks, models.BalanceCheck{UserId: u.UserId, Balance: u.Balance, Expected: expected[models.UserAccount(u.UserId)]})
+	}
+
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].UserId < checks[j].UserId
+	})
+
+	return checks, nil
+}
+
+func (r *MemoryRepository) RepairBalance(userId string, old, balance models.Money) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user := r.user(userId)
+	if user == nil {
+		return ErrUserNotFound
+	}
+
+	if user.Balance != old {
+		return ErrBalanceChanged
+	}
+
+	user.Balance = balance
+	user.UpdatedAt = time.Now()
+	if l := r.ledger(userId); l != balance {
+		r.post(models.AdjustmentEntry(userId, balance-l))
+	}
+	return nil
+}
+
+// must be called with lock
+func (r *MemoryRepository) user(id string) *models.User {
+	for k := range r.users {
+		if r.users[k].UserId == id {
+			return &r.users[k]
+		}
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) CreateProvider(provider *models.Provider) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range r.providers {
+		if v.Name == provider.Name {
+			return fmt.Errorf("provider %s already exists", provider.Name)
+		}
+	}
+
+	r.providerSeq++
+	provider.ID = r.providerSeq
+	provider.CreatedAt = time.Now()
+	provider.UpdatedAt = provider.CreatedAt
+
+	r.providers = append(r.providers, *provider)
+	return nil
+}
+
+func (r *MemoryRepository) SaveProvider(provider *models.Provider) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k := range r.providers {
+		if r.providers[k].ID == provider.ID {
+			provider.UpdatedAt = time.Now()
+			r.providers[k] = *provider
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (r *MemoryRepository) FetchProviders() ([]models.Provider, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	providers := make([]models.Provider, len(r.providers))
+	copy(providers, r.providers)
+
+	return providers, nil
+}
+
+func (r *MemoryRepository) CreateSourceType(sourceType *models.SourceType) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := 0
+	for _, v := range r.sources {
+		if v.Name == sourceType.Name {
+			return fmt.Errorf("source type %s already exists", sourceType.Name)
+		}
+
+		if v.ID >= id {
+			id = v.ID + 1
+		}
+	}
+
+	sourceType.ID = id
+	sourceType.CreatedAt = time.Now()
+
+	r.sources = append(r.sources, *sourceType)
+	return nil
+}
+
+func (r *MemoryRepository) SaveSourceType(sourceType *models.SourceType) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k := range r.sources {
+		if r.sources[k].ID == sourceType.ID {
+			r.sources[k].Enabled = sourceType.Enabled
+			r.sources[k].Rules = sourceType.Rules
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (r *MemoryRepository) FetchSourceTypes() ([]models.SourceType, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	types := make([]models.SourceType, len(r.sources))
+	copy(types, r.sources)
+
+	return types, nil
+}
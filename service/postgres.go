@@ -0,0 +1,588 @@
+package service
+
+import (
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// user and ledger account in one database transaction
+func (r *TaskRepository) CreateUser(user *models.User) error {
+
+	tx := r.Db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := tx.Create(user).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := openAccount(tx, *user); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+func (r *TaskRepository) FetchUsers() ([]models.User, error) {
+	users := make([]models.User, 0)
+
+	err := r.Db.Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (r *TaskRepository) FindUser(userId string) (models.User, error) {
+	var user models.User
+
+	err := r.Db.Where("user_id = ?", userId).First(&user).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return user, ErrUserNotFound
+	}
+
+	return user, err
+}
+
+func (r *TaskRepository) CreateData(data *models.Data) error {
+	return r.Db.Create(data).Error
+}
+
+// multi row insert in one database transaction. journal entries of processed records inserted too
+// large batches copied with COPY
+func (r *TaskRepository) InsertTransactions(transactions []models.Data) error {
+
+	if len(transactions) == 0 {
+		return nil
+	}
+
+	if r.Pool != nil && len(transactions) >= CopyMinRows {
+		return r.copyTransactions(transactions)
+	}
+
+	tx := r.Db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	// ids known before insert. journal entries reference records
+	ids, err := nextIds(tx, "data", len(transactions))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var value []string
+	var values []interface{}
+	var entries []models.JournalEntry
+	for k, data := range transactions {
+		data.ID = ids[k]
+		if data.Status == models.StatusProcessed {
+			entries = append(entries, models.TransactionEntry(data))
+		}
+
+		value = append(value, "(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)")
+		values = append(values, data.ID)
+		values = append(values, data.CreatedAt)
+		values = append(values, data.UpdatedAt)
+		values = append(values, data.DeletedAt)
+		values = append(values, data.UserId)
+		values = append(values, data.State)
+		values = append(values, data.Status)
+		values = append(values, data.Source)
+		values = append(values, data.ProviderId)
+		values = append(values, data.Amount)
+		values = append(values, data.TransactionId)
+		values = append(values, data.Balance)
+		values = append(values, data.RequestHash)
+		values = append(values, data.Code)
+		values = append(values, data.Message)
+	}
+
+	stmt := fmt.Sprintf("INSERT INTO data (id, created_at, updated_at, deleted_at, user_id, state, status, source, provider_id, amount, transaction_id, balance, request_hash, code, message) VALUES %s", strings.Join(value, ","))
+	if err := tx.Exec(stmt, values...).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := postEntries(tx, entries); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+func (r *TaskRepository) FetchTransactions() ([]models.Data, error) {
+	transactions := make([]models.Data, 0)
+
+	err := r.Db.Find(&transactions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+func (r *TaskRepository) FindTransaction(transactionId string) (models.Data, error) {
+	var data models.Data
+
+	err := r.Db.Where("transaction_id = ?", transactionId).First(&data).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return data, ErrNotFound
+	}
+
+	return data, err
+}
+
+// keyset pagination over data.id. uses index on (user_id, id)
+func (r *TaskRepository) UserTransactions(f models.TransactionFilter) ([]models.Data, error) {
+
+	q := r.Db.Where("user_id = ?", f.UserId)
+
+	if f.Cursor > 0 {
+		q = q.Where("id < ?", f.Cursor)
+	}
+
+	if f.State != nil {
+		q = q.Where("state = ?", *f.State)
+	}
+
+	if f.Status != 0 {
+		q = q.Where("status = ?", f.Status)
+	}
+
+	if f.Source != nil {
+		q = q.Where("source = ?", *f.Source)
+	}
+
+	if f.MinAmount != nil {
+		q = q.Where("amount >= ?", *f.MinAmount)
+	}
+
+	if f.MaxAmount != nil {
+		q = q.Where("amount <= ?", *f.MaxAmount)
+	}
+
+	if !f.From.IsZero() {
+		q = q.Where("created_at >= ?", f.From)
+	}
+
+	if !f.To.IsZero() {
+		q = q.Where("created_at < ?", f.To)
+	}
+
+	data := make([]models.Data, 0)
+
+	err := q.Order("id DESC").Limit(f.Limit).Find(&data).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// one parameterized update per batch. user ids never formatted into query
+// in-memory balance written only if it is equal to ledger. postings of records written by bulk insert, cancels by CancelTransaction
+func (r *TaskRepository) UpdateBalances(balances []models.UserBalance) error {
+
+	if len(balances) == 0 {
+		return nil
+	}
+
+	var value []string
+	var values []interface{}
+	for _, b := range balances {
+		value = append(value, "(?::text, ?::numeric)")
+		values = append(values, b.UserId, b.Amount)
+	}
+
+	stmt := fmt.Sprintf("UPDATE users AS u SET balance = data.a, updated_at = now() FROM (VALUES %s) AS data(user_id, a) "+
+		"WHERE u.user_id = data.user_id AND data.a = (SELECT COALESCE(SUM(p.amount), 0) FROM postings p WHERE p.account = ?::text || u.user_id)", strings.Join(value, ","))
+	db := r.Db.Exec(stmt, append(values, models.AccountUser+":")...)
+	if db.Error != nil {
+		return db.Error
+	}
+
+	// not registered users and balances different from ledger not written
+	if n := int64(len(balances)) - db.RowsAffected; n > 0 {
+		return fmt.Errorf("%w: %d of %d balances not written", ErrLedgerMismatch, n, len(balances))
+	}
+
+	return nil
+}
+
+// journal entries of dead letter posted in same database transaction
+func (r *TaskRepository) SaveDeadLetter(letter *models.DeadLetter, entries ...models.JournalEntry) error {
+
+	if len(entries) == 0 {
+		return r.Db.Create(letter).Error
+	}
+
+	tx := r.Db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := tx.Create(letter).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := postEntries(tx, entries); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// latest first
+func (r *TaskRepository) FetchDeadLetters() ([]models.DeadLetter, error) {
+	letters := make([]models.DeadLetter, 0)
+
+	err := r.Db.Order("id DESC").Find(&letters).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return letters, nil
+}
+
+// latest records of filter
+func (r *TaskRepository) CancelCandidates(f models.CancelFilter) ([]models.Data, error) {
+	var data []models.Data
+
+	db := r.Db.Table("data")
+	switch f.Parity {
+	case models.ParityOdd:
+		db = db.Where("MOD (id, 2) = 1")
+	case models.ParityEven:
+		db = db.Where("MOD (id, 2) = 0")
+	}
+
+	if f.UserId != "" {
+		db = db.Where("user_id = ?", f.UserId)
+	}
+
+	if f.Source != nil {
+		db = db.Where("source = ?", *f.Source)
+	}
+
+	if len(f.Exclude) > 0 {
+		db = db.Where("source NOT IN (?)", f.Exclude)
+	}
+
+	if f.MinAmount != nil {
+		db = db.Where("amount >= ?", *f.MinAmount)
+	}
+
+	if f.MaxAmount != nil {
+		db = db.Where("amount <= ?", *f.MaxAmount)
+	}
+
+	if !f.From.IsZero() {
+		db = db.Where("created_at >= ?", f.From)
+	}
+
+	if !f.To.IsZero() {
+		db = db.Where("created_at < ?", f.To)
+	}
+
+	err := db.Order("id  DESC").Limit(f.Limit).Find(&data).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// buffered mode cancel. balance checked with memory balance before
+// status and cancellation changed in one database transaction only if record not canceled yet
+func (r *TaskRepository) CancelTransaction(data *models.Data, cancel *models.Cancellation) error {
+
+	tx := r.Db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := setCancelStatus(tx, data, models.StatusCanceled); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// users.balance not changed. in-memory balance with cancel saved by balance update
+	c := *cancel
+	if err := tx.Create(&c).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := postEntries(tx, []models.JournalEntry{models.CancelEntry(*data, c)}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	*cancel = c
+	data.Status = models.StatusCanceled
+	return nil
+}
+
+// buffered mode denied cancel. record never selected by post processing again
+func (r *TaskRepository) DenyCancel(data *models.Data, cancel *models.Cancellation) error {
+
+	tx := r.Db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := setCancelStatus(tx, data, models.StatusCancelDenied); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	c := *cancel
+	if err := tx.Create(&c).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	*cancel = c
+	data.Status = models.StatusCancelDenied
+	return nil
+}
+
+// cancellations of transaction record. oldest first
+func (r *TaskRepository) FetchCancellations(dataId uint) ([]models.Cancellation, error) {
+	var cancellations []models.Cancellation
+
+	err := r.Db.Where("data_id = ?", dataId).Order("id").Find(&cancellations).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return cancellations, nil
+}
+
+// change status of record not canceled yet. processed (status 1) or cancel denied before (status 4)
+// ErrAlreadyCanceled if record canceled or not processed
+func setCancelStatus(tx *gorm.DB, data *models.Data, status uint8) error {
+
+	res := tx.Model(&models.Data{}).Where("id = ? AND status IN (1, 4)", data.ID).Update("status", status)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrAlreadyCanceled
+	}
+
+	return nil
+}
+
+// lock user row, change balance and insert transaction record in one database transaction
+// journal entry of record posted in same database transaction. new balance must be equal to ledger
+func (r *TaskRepository) ApplyTransaction(data *models.Data) (models.Money, error) {
+
+	tx := r.Db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	user, err := lockUser(tx, data.UserId)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	// negative balance only with rule of source type. win for already negative balance accepted
+	balance := user.Balance + data.Delta()
+	if balance < 0 && balance < user.Balance && !data.AllowNegative {
+		tx.Rollback()
+		return user.Balance, ErrNotEnoughBalance
+	}
+
+	if err := tx.Model(user).Update("balance", balance).Error; err != nil {
+		tx.Rollback()
+		return user.Balance, err
+	}
+
+	data.Status = 1
+	data.Balance = balance
+	if err := tx.Create(data).Error; err != nil {
+		tx.Rollback()
+		return user.Balance, err
+	}
+
+	if err := postEntries(tx, []models.JournalEntry{models.TransactionEntry(*data)}); err != nil {
+		tx.Rollback()
+		return user.Balance, err
+	}
+
+	if err := checkProjection(tx, data.UserId, balance); err != nil {
+		tx.Rollback()
+		return user.Balance, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return user.Balance, err
+	}
+
+	return balance, nil
+}
+
+// reverse processed transaction. status changes only if record not canceled yet
+// cancel which makes balance negative denied. denied status and cancellation committed, ErrNotEnoughBalance returned
+func (r *TaskRepository) ApplyCancel(data *models.Data, cancel *models.Cancellation) (models.Money, error) {
+
+	tx := r.Db.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+
+	user, err := lockUser(tx, data.UserId)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	c := *cancel
+	status := models.StatusCanceled
+	balance := user.Balance - c.Delta(*data)
+	if balance < 0 && balance < user.Balance && !data.AllowNegative {
+		status = models.StatusCancelDenied
+		balance = user.Balance
+		c.Deny(user.Balance)
+	} else {
+		c.Apply(*data, user.Balance)
+	}
+
+	if err := setCancelStatus(tx, data, status); err != nil {
+		tx.Rollback()
+		return user.Balance, err
+	}
+
+	if balance != user.Balance {
+		if err := tx.Model(user).Update("balance", balance).Error; err != nil {
+			tx.Rollback()
+			return user.Balance, err
+		}
+	}
+
+	if err := tx.Create(&c).Error; err != nil {
+		tx.Rollback()
+		return user.Balance, err
+	}
+
+	if status == models.StatusCanceled {
+		if err := postEntries(tx, []models.JournalEntry{models.CancelEntry(*data, c)}); err != nil {
+			tx.Rollback()
+			return user.Balance, err
+		}
+
+		if err := checkProjection(tx, data.UserId, balance); err != nil {
+			tx.Rollback()
+			return user.Balance, err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return user.Balance, err
+	}
+
+	*cancel = c
+	data.Status = status
+	if status == models.StatusCancelDenied {
+		return balance, ErrNotEnoughBalance
+	}
+
+	return balance, nil
+}
+
+// select user row for update. other transactions of same user wait until commit
+func lockUser(tx *gorm.DB, id string) (*models.User, error) {
+	user := new(models.User)
+
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("user_id = ?", id).First(user).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, ErrUserNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (r *TaskRepository) CreateProvider(provider *models.Provider) error {
+	return r.Db.Create(provider).Error
+}
+
+func (r *TaskRepository) SaveProvider(provider *models.Provider) error {
+	return r.Db.Save(provider).Error
+}
+
+func (r *TaskRepository) FetchProviders() ([]models.Provider, error) {
+	providers := make([]models.Provider, 0)
+
+	err := r.Db.Order("id").Find(&providers).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return providers, nil
+}
+
+// next id assigned in same statement. primary key rejects concurrent insert with same id
+func (r *TaskRepository) CreateSourceType(sourceType *models.SourceType) error {
+	sourceType.CreatedAt = time.Now()
+
+	rules := sourceType.Rules
+
+	return r.Db.Raw(`INSERT INTO source_types (id, name, enabled, created_at, states, min_amount, max_amount, not_cancelable, allow_negative)
+		SELECT COALESCE(MAX(id) + 1, 0), ?, ?, ?, ?, ?, ?, ?, ? FROM source_types RETURNING id`,
+		sourceType.Name, sourceType.Enabled, sourceType.CreatedAt,
+		rules.States, rules.MinAmount, rules.MaxAmount, rules.NotCancelable, rules.AllowNegative).Row().Scan(&sourceType.ID)
+}
+
+// enabled flag and rules. name never changed
+// id condition explicit. gorm leaves out primary key condition of zero id, "game" has id 0
+func (r *TaskRepository) SaveSourceType(sourceType *models.SourceType) error {
+	rules := sourceType.Rules
+
+	return r.Db.Model(&models.SourceType{}).Where("id = ?", sourceType.ID).Updates(map[string]interface{}{
+		"enabled":        sourceType.Enabled,
+		"states":         rules.States,
+		"min_amount":     rules.MinAmount,
+		"max_amount":     rules.MaxAmount,
+		"not_cancelable": rules.NotCancelable,
+		"allow_negative": rules.AllowNegative,
+	}).Error
+}
+
+func (r *TaskRepository) FetchSourceTypes() ([]models.SourceType, error) {
+	types := make([]models.SourceType, 0)
+
+	err := r.Db.Order("id").Find(&types).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return types, nil
+}
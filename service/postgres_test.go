@@ -0,0 +1,122 @@
+package service
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/SaCavid/simple-task/models"
+	"github.com/jinzhu/gorm"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// database/sql driver saving statements instead of running them. sql of postgres repository checked without database
+type recordDriver struct {
+	mu    sync.Mutex
+	execs []recordedExec
+}
+
+type recordedExec struct {
+	query string
+	args  []driver.Value
+}
+
+type recordConn struct{ d *recordDriver }
+
+type recordStmt struct {
+	d     *recordDriver
+	query string
+}
+
+type recordRows struct{}
+
+func (d *recordDriver) Open(string) (driver.Conn, error) { return recordConn{d}, nil }
+
+func (c recordConn) Prepare(query string) (driver.Stmt, error) {
+	return recordStmt{d: c.d, query: query}, nil
+}
+func (c recordConn) Close() error              { return nil }
+func (c recordConn) Begin() (driver.Tx, error) { return c, nil }
+func (c recordConn) Commit() error             { return nil }
+func (c recordConn) Rollback() error           { return nil }
+
+func (s recordStmt) Close() error  { return nil }
+func (s recordStmt) NumInput() int { return -1 }
+
+func (s recordStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	s.d.execs = append(s.d.execs, recordedExec{query: s.query, args: args})
+	s.d.mu.Unlock()
+
+	return driver.RowsAffected(1), nil
+}
+
+func (s recordStmt) Query([]driver.Value) (driver.Rows, error) { return recordRows{}, nil }
+
+func (recordRows) Columns() []string         { return nil }
+func (recordRows) Close() error              { return nil }
+func (recordRows) Next([]driver.Value) error { return io.EOF }
+
+func newRecordRepository(t *testing.T) (*TaskRepository, *recordDriver) {
+	t.Helper()
+
+	d := &recordDriver{}
+	name := "record-" + t.Name()
+	sql.Register(name, d)
+
+	conn, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := gorm.Open("postgres", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &TaskRepository{Db: db}, d
+}
+
+// source type with id 0 updated only. gorm leaves out zero primary key from where clause of Model
+func TestTaskRepository_SaveSourceType(t *testing.T) {
+	repo, d := newRecordRepository(t)
+
+	game := models.SourceType{ID: 0, Name: "game", Enabled: false, Rules: models.SourceRules{MaxAmount: 10000}}
+	if err := repo.SaveSourceType(&game); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.execs) != 1 {
+		t.Fatalf("expected one update, got %+v", d.execs)
+	}
+
+	e := d.execs[0]
+	if !strings.HasPrefix(e.query, `UPDATE "source_types"`) || !strings.Contains(e.query, "WHERE (id = $") {
+		t.Fatalf("update without id condition: %s", e.query)
+	}
+
+	if id := e.args[len(e.args)-1]; id != int64(0) {
+		t.Fatalf("expected id 0 as last argument, got %v in %s", id, e.query)
+	}
+}
+
+// balance written only if equal to sum of user account postings. not written balances reported
+func TestTaskRepository_UpdateBalances(t *testing.T) {
+	repo, d := newRecordRepository(t)
+
+	if err := repo.UpdateBalances([]models.UserBalance{{UserId: "u-1", Amount: 1015}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if q := d.execs[0].query; !strings.Contains(q, "data.a = (SELECT COALESCE(SUM(p.amount), 0) FROM postings p WHERE p.account = $3::text || u.user_id)") {
+		t.Fatalf("update without ledger condition: %s", q)
+	}
+
+	// recorded update affects one row
+	err := repo.UpdateBalances([]models.UserBalance{{UserId: "u-1", Amount: 1015}, {UserId: "u-2", Amount: 500}})
+	if !errors.Is(err, ErrLedgerMismatch) || !RowError(err) {
+		t.Fatalf("expected ledger mismatch row error, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"github.com/SaCavid/simple-task/models"
+)
+
+// users.balance and balance recomputed from records in one query. same snapshot, no false differences
+// opening entries of ledger are balances of registration and not explained by records before ledger
+func (r *TaskRepository) ReconcileBalances() ([]models.BalanceCheck, error) {
+	checks := make([]models.BalanceCheck, 0)
+
+	err := r.Db.Raw(`WITH reversed AS (
+			SELECT data_id, MAX(amount) AS amount FROM cancellations WHERE outcome = ? GROUP BY data_id
+		), records AS (
+			SELECT d.user_id, SUM(CASE WHEN d.state THEN 1 ELSE -1 END * (d.amount - CASE WHEN d.status = ? THEN COALESCE(NULLIF(c.amount, 0), d.amount) ELSE 0 END)) AS amount
+			FROM data d LEFT JOIN reversed c ON c.data_id = d.id WHERE d.status IN (?) GROUP BY d.user_id
+		), openings AS (
+			SELECT p.account, SUM(p.amount) AS amount FROM postings p JOIN journal_entries e ON e.id = p.entry_id WHERE e.kind = ? GROUP BY p.account
+		)
+		SELECT u.user_id, u.balance, COALESCE(o.amount, 0) + COALESCE(d.amount, 0) AS expected
+		FROM users u LEFT JOIN records d ON d.user_id = u.user_id LEFT JOIN openings o ON o.account = ?::text || u.user_id
+		ORDER BY u.user_id`,
+		models.CancelApplied, models.StatusCanceled, []uint8{models.StatusProcessed, models.StatusCanceled, models.StatusCancelDenied},
+		models.EntryOpening, models.AccountUser+":").Scan(&checks).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return checks, nil
+}
+
+// set balance only if users.balance not changed after check
+// difference of balance and ledger posted as adjustment entry in same database transaction. ledger explains repaired balance
+func (r *TaskRepository) RepairBalance(userId string, old, balance models.Money) error {
+
+	tx := r.Db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	db := tx.Exec("UPDATE users SET balance = ?, updated_at = now() WHERE user_id = ? AND balance = ?", balance, userId, old)
+	if db.Error != nil {
+		tx.Rollback()
+		return db.Error
+	}
+
+	if db.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrBalanceChanged
+	}
+
+	ledger, err := ledgerBalance(tx, userId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if balance != ledger {
+		if err := postEntries(tx, []models.JournalEntry{models.AdjustmentEntry(userId, balance-ledger)}); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// postings committed after sum by bulk insert
+	if err := checkProjection(tx, userId, balance); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
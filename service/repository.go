@@ -0,0 +1,70 @@
+package service
+
+import (
+	"errors"
+	"github.com/SaCavid/simple-task/models"
+)
+
+// Repository is storage used by handlers.Server
+// TaskRepository --> postgres. MemoryRepository --> in-memory storage for testing without database
+type Repository interface {
+
+	// users
+	CreateUser(user *models.User) error
+	FetchUsers() ([]models.User, error)
+	FindUser(userId string) (models.User, error)
+
+	// transactions
+	CreateData(data *models.Data) error
+	InsertTransactions(transactions []models.Data) error
+	FetchTransactions() ([]models.Data, error)
+	FindTransaction(transactionId string) (models.Data, error)
+	UserTransactions(filter models.TransactionFilter) ([]models.Data, error)
+
+	// balances. ErrBadRow or postgres data error --> batch has row which can never be written
+	// balance written only if equal to sum of user account postings. ErrLedgerMismatch --> not equal balances not written
+	UpdateBalances(balances []models.UserBalance) error
+
+	// rows which can never be written. journal entries posted in same database transaction
+	SaveDeadLetter(letter *models.DeadLetter, entries ...models.JournalEntry) error
+	FetchDeadLetters() ([]models.DeadLetter, error)
+
+	// cancellations. audit row saved in same database transaction as record status
+	CancelCandidates(filter models.CancelFilter) ([]models.Data, error)
+	// status changed only if record processed or cancel denied before. users.balance saved with in-memory balance by balance update
+	CancelTransaction(data *models.Data, cancel *models.Cancellation) error // buffered mode
+	DenyCancel(data *models.Data, cancel *models.Cancellation) error        // buffered mode. status changed to cancel denied
+	FetchCancellations(dataId uint) ([]models.Cancellation, error)
+
+	// durable mode. user balance and transaction record changed in one database transaction
+	// returns user balance after operation
+	ApplyTransaction(data *models.Data) (models.Money, error)
+	ApplyCancel(data *models.Data, cancel *models.Cancellation) (models.Money, error) // ErrNotEnoughBalance --> cancel denied and saved
+
+	// double entry ledger. journal entries posted in same database transaction as records and cancellations
+	UserLedger(userId string) ([]models.LedgerLine, error)
+	CheckLedger() (models.LedgerReport, error)
+
+	// reconciliation. balances recomputed from transaction records
+	ReconcileBalances() ([]models.BalanceCheck, error)
+	RepairBalance(userId string, old, balance models.Money) error // ErrBalanceChanged --> users.balance not old anymore
+
+	// providers
+	CreateProvider(provider *models.Provider) error
+	SaveProvider(provider *models.Provider) error
+	FetchProviders() ([]models.Provider, error)
+
+	// source types. id of new source type assigned by repository
+	CreateSourceType(sourceType *models.SourceType) error
+	SaveSourceType(sourceType *models.SourceType) error
+	FetchSourceTypes() ([]models.SourceType, error)
+}
+
+var (
+	ErrNotFound         = errors.New("record not found")
+	ErrUserNotFound     = errors.New("user didnt registered")
+	ErrNotEnoughBalance = errors.New("not enough user balance")
+	ErrAlreadyCanceled  = errors.New("transaction already canceled or not processed")
+	ErrBalanceChanged   = errors.New("user balance changed")
+	ErrLedgerMismatch   = errors.New("user balance differs from ledger")
+)
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"errors"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+	"time"
+)
+
+// row can never be written. retrying same row fails again
+var ErrBadRow = errors.New("row can never be written")
+
+// record with same transaction id saved before. same as unique violation of TransactionIdIndex
+var ErrDuplicateTransaction = errors.New("duplicate transaction id")
+
+// unique index of data.transaction_id
+const TransactionIdIndex = "uix_data_transaction_id"
+
+// true --> error caused by data of row, not by database or connection
+// postgres data exception (22) and integrity constraint violation (23) classes
+func RowError(err error) bool {
+	if errors.Is(err, ErrBadRow) || errors.Is(err, ErrLedgerMismatch) || errors.Is(err, ErrDuplicateTransaction) {
+		return true
+	}
+
+	var e *pq.Error
+	if errors.As(err, &e) {
+		switch e.Code.Class() {
+		case "22", "23":
+			return true
+		}
+	}
+
+	// COPY errors of pgx
+	var pe *pgconn.PgError
+	if errors.As(err, &pe) && len(pe.Code) == 5 {
+		switch pe.Code[:2] {
+		case "22", "23":
+			return true
+		}
+	}
+
+	return false
+}
+
+// true --> unique index of transaction id violated. record with same transaction id in database
+func DuplicateTransaction(err error) bool {
+	if errors.Is(err, ErrDuplicateTransaction) {
+		return true
+	}
+
+	var e *pq.Error
+	if errors.As(err, &e) {
+		return e.Code == "23505" && e.Constraint == TransactionIdIndex
+	}
+
+	var pe *pgconn.PgError
+	if errors.As(err, &pe) {
+		return pe.Code == "23505" && pe.ConstraintName == TransactionIdIndex
+	}
+
+	return false
+}
+
+// exponential delay between retries. Min doubled every retry up to Max
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+
+	next time.Duration
+}
+
+func (b *Backoff) Next() time.Duration {
+	if b.next < b.Min {
+		b.next = b.Min
+	}
+
+	d := b.next
+	if b.next *= 2; b.next > b.Max {
+		b.next = b.Max
+	}
+
+	return d
+}
+
+// next delay is Min again. used after success
+func (b *Backoff) Reset() {
+	b.next = 0
+}
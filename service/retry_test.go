@@ -0,0 +1,67 @@
+package service
+
+import (
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+	"testing"
+	"time"
+)
+
+func TestRowError(t *testing.T) {
+	tests := []struct {
+		err error
+		row bool
+	}{
+		{fmt.Errorf("balance of user: %w", ErrBadRow), true},
+		{&pq.Error{Code: "22021"}, true}, // invalid byte sequence
+		{&pq.Error{Code: "23505"}, true}, // unique violation
+		{&pq.Error{Code: "08006"}, false},
+		{&pq.Error{Code: "57P01"}, false},
+		{fmt.Errorf("copy: %w", &pgconn.PgError{Code: "22021"}), true},
+		{&pgconn.PgError{Code: "08006"}, false},
+		{fmt.Errorf("connection refused"), false},
+	}
+
+	for _, v := range tests {
+		if RowError(v.err) != v.row {
+			t.Fatalf("%v: expected row error %v", v.err, v.row)
+		}
+	}
+}
+
+func TestDuplicateTransaction(t *testing.T) {
+	tests := []struct {
+		err       error
+		duplicate bool
+	}{
+		{fmt.Errorf("%w t-1", ErrDuplicateTransaction), true},
+		{&pq.Error{Code: "23505", Constraint: TransactionIdIndex}, true},
+		{&pq.Error{Code: "23505", Constraint: "journal_entries_pkey"}, false},
+		{fmt.Errorf("copy: %w", &pgconn.PgError{Code: "23505", ConstraintName: TransactionIdIndex}), true},
+		{&pgconn.PgError{Code: "23502", ConstraintName: TransactionIdIndex}, false},
+		{fmt.Errorf("connection refused"), false},
+	}
+
+	for _, v := range tests {
+		if DuplicateTransaction(v.err) != v.duplicate {
+			t.Fatalf("%v: expected duplicate %v", v.err, v.duplicate)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second}
+
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for _, v := range expected {
+		if d := b.Next(); d != v*time.Millisecond {
+			t.Fatalf("expected %v, got %v", v*time.Millisecond, d)
+		}
+	}
+
+	b.Reset()
+	if d := b.Next(); d != 100*time.Millisecond {
+		t.Fatalf("expected min delay after reset, got %v", d)
+	}
+}
@@ -0,0 +1,423 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/SaCavid/simple-task/models"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	WALTransaction = "transaction" // accepted transaction. must be inserted to database
+	WALCancel      = "cancel"      // post processing cancel. record status must be changed in database
+	WALBalance     = "balance"     // balance set without transaction. reconciliation repair
+)
+
+// active segment rotated by Compact from this size
+const WALSegmentSize = 64 << 20
+
+// write or fsync failed. state of log file unknown, records after failure not accepted
+var ErrWALFailed = errors.New("write-ahead log failed")
+
+// one line of write-ahead log
+type WALRecord struct {
+	Seq  uint64      `json:"seq"`
+	Kind string      `json:"kind"`
+	Data models.Data `json:"data"`
+
+	// user balance after operation. nil if operation didnt change balance
+	Balance *models.Money `json:"balance,omitempty"`
+
+	// audit row of cancel record. nil in logs written before cancellations saved
+	Cancel *models.Cancellation `json:"cancel,omitempty"`
+}
+
+// WAL is append-only log for buffered mode. segment files <path>.<number>, last segment is active.
+// every accepted transaction written and fsynced before response.
+// replayed on startup. segments removed by Compact after their records saved to database, never rewritten
+type WAL struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File     // active segment
+	size     int64        // bytes of complete records in active segment
+	seq      uint64       // last written record
+	segments []walSegment // oldest first
+	err      error        // sticky ErrWALFailed
+
+	syncMu sync.Mutex
+	synced uint64 // last fsynced record
+
+	// active segment rotated from this size. 0 --> WALSegmentSize
+	SegmentSize int64
+}
+
+type walSegment struct {
+	number int
+	last   uint64 // last record. 0 --> empty
+}
+
+func OpenWAL(path string) (*WAL, error) {
+
+	w := &WAL{path: path}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	// single file of log before segments
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		if err := os.Rename(path, w.segmentPath(0)); err != nil {
+			return nil, err
+		}
+	}
+
+	names, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		n, err := strconv.Atoi(strings.TrimPrefix(name, path+"."))
+		if err != nil || n < 0 {
+			continue
+		}
+		w.segments = append(w.segments, walSegment{number: n})
+	}
+
+	sort.Slice(w.segments, func(i, j int) bool {
+		return w.segments[i].number < w.segments[j].number
+	})
+
+	for k := range w.segments {
+		records, err := w.readSegment(w.segments[k].number)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range records {
+			if r.Seq > w.segments[k].last {
+				w.segments[k].last = r.Seq
+			}
+		}
+
+		if w.segments[k].last > w.seq {
+			w.seq = w.segments[k].last
+		}
+	}
+	w.synced = w.seq
+
+	// new active segment. broken last line of previous segment never continued
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// write record to active segment without fsync. assigns record sequence
+// Sync must be called before response. failed write truncated, log never has broken line before good records
+func (w *WAL) Write(r *WALRecord) error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	seq := w.seq + 1
+	r.Seq = seq
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	n, err := w.file.Write(append(b, '\n'))
+	if err != nil {
+		if n > 0 {
+			if terr := w.file.Truncate(w.size); terr != nil {
+				w.err = fmt.Errorf("%w: %v. truncate: %v", ErrWALFailed, err, terr)
+				return w.err
+			}
+		}
+		return fmt.Errorf("%w: %v", ErrWALFailed, err)
+	}
+
+	w.size += int64(n)
+	w.seq = seq
+	w.segments[len(w.segments)-1].last = seq
+	return nil
+}
+
+// fsync active segment if record with seq is not synced yet
+// concurrent callers share one fsync. failed fsync --> log failed, records after it not accepted
+func (w *WAL) Sync(seq uint64) error {
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	if w.synced >= seq {
+		return nil
+	}
+
+	// segments rotated only with syncMu. file not closed while syncing
+	w.mu.Lock()
+	if w.err != nil {
+		w.mu.Unlock()
+		return w.err
+	}
+	last := w.seq
+	f := w.file
+	w.mu.Unlock()
+
+	if err := f.Sync(); err != nil {
+		w.mu.Lock()
+		w.err = fmt.Errorf("%w: %v", ErrWALFailed, err)
+		w.mu.Unlock()
+		return w.err
+	}
+
+	w.synced = last
+	return nil
+}
+
+// last written record sequence
+func (w *WAL) Seq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// all records sorted by sequence
+// last line of segment can be broken if process crashed while writing. it is ignored
+func (w *WAL) Records() ([]WALRecord, error) {
+
+	w.mu.Lock()
+	segments := append([]walSegment(nil), w.segments...)
+	w.mu.Unlock()
+
+	records := make([]WALRecord, 0)
+	for _, s := range segments {
+		list, err := w.readSegment(s.number)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, list...)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+
+	return records, nil
+}
+
+func (w *WAL) readSegment(number int) ([]WALRecord, error) {
+
+	path := w.segmentPath(number)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := make([]WALRecord, 0)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r walLine
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			if scanner.Scan() {
+				return nil, fmt.Errorf("wal %s: %v", path, err)
+			}
+			break // broken last line
+		}
+		records = append(records, r.record())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// remove segments saved to database. segment removed when all its records have Seq <= upTo
+// active segment rotated when bigger than SegmentSize. saved records of active segment replayed again after restart, replay skips them
+func (w *WAL) Compact(upTo uint64) error {
+
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	w.mu.Lock()
+	active := w.segments[len(w.segments)-1]
+	size := w.SegmentSize
+	if size <= 0 {
+		size = WALSegmentSize
+	}
+
+	var old *os.File
+	if w.size >= size {
+		old = w.file
+		if err := w.rotate(); err != nil {
+			w.mu.Unlock()
+			return err
+		}
+	}
+
+	remove := make([]int, 0)
+	kept := make([]walSegment, 0, len(w.segments))
+	for k, s := range w.segments {
+		if k < len(w.segments)-1 && s.last <= upTo {
+			remove = append(remove, s.number)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	w.segments = kept
+	w.mu.Unlock()
+
+	// records of rotated segment synced before response of their writers
+	if old != nil {
+		err := old.Sync()
+		old.Close()
+		if err != nil {
+			w.mu.Lock()
+			w.err = fmt.Errorf("%w: %v", ErrWALFailed, err)
+			w.mu.Unlock()
+			return w.err
+		}
+
+		if active.last > w.synced {
+			w.synced = active.last
+		}
+	}
+
+	for _, n := range remove {
+		if err := os.Remove(w.segmentPath(n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if old == nil && len(remove) == 0 {
+		return nil
+	}
+
+	// new and removed files must survive crash too
+	return w.syncDir()
+}
+
+// new empty active segment. must be called with mu locked
+func (w *WAL) rotate() error {
+
+	number := 1
+	if len(w.segments) > 0 {
+		number = w.segments[len(w.segments)-1].number + 1
+	}
+
+	f, err := os.OpenFile(w.segmentPath(number), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	w.file = f
+	w.size = 0
+	w.segments = append(w.segments, walSegment{number: number})
+
+	return w.syncDir()
+}
+
+func (w *WAL) segmentPath(number int) string {
+	return fmt.Sprintf("%s.%010d", w.path, number)
+}
+
+func (w *WAL) syncDir() error {
+	dir, err := os.Open(filepath.Dir(w.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// line of log. balances can be negative, Money json of api requests rejects them
+// fields of line shadow Money fields of embedded records
+type walLine struct {
+	WALRecord
+	Data    walData    `json:"data"`
+	Balance *walMoney  `json:"balance,omitempty"`
+	Cancel  *walCancel `json:"cancel,omitempty"`
+}
+
+type walData struct {
+	models.Data
+	Amount  walMoney
+	Balance walMoney
+}
+
+type walCancel struct {
+	models.Cancellation
+	Amount        walMoney `json:"amount"`
+	BalanceBefore walMoney `json:"balanceBefore"`
+	BalanceAfter  walMoney `json:"balanceAfter"`
+}
+
+type walMoney models.Money
+
+func (m *walMoney) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := models.ParseSignedMoney(s)
+	if err != nil {
+		return err
+	}
+
+	*m = walMoney(v)
+	return nil
+}
+
+func (l walLine) record() WALRecord {
+	r := l.WALRecord
+
+	r.Data = l.Data.Data
+	r.Data.Amount = models.Money(l.Data.Amount)
+	r.Data.Balance = models.Money(l.Data.Balance)
+
+	if l.Balance != nil {
+		b := models.Money(*l.Balance)
+		r.Balance = &b
+	}
+
+	if l.Cancel != nil {
+		c := l.Cancel.Cancellation
+		c.Amount = models.Money(l.Cancel.Amount)
+		c.BalanceBefore = models.Money(l.Cancel.BalanceBefore)
+		c.BalanceAfter = models.Money(l.Cancel.BalanceAfter)
+		r.Cancel = &c
+	}
+
+	return r
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/SaCavid/simple-task/models"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal", "transactions.wal")
+
+	w, err := OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balance := models.Money(1015)
+	for _, id := range []string{"w-1", "w-2", "w-3"} {
+		r := WALRecord{Kind: WALTransaction, Data: models.Data{TransactionId: id, Amount: 1015}, Balance: &balance}
+		if err := w.Write(&r); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.Sync(r.Seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// active segment not rotated before size limit. saved records kept
+	if err := w.Compact(3); err != nil {
+		t.Fatal(err)
+	}
+
+	if records, err := w.Records(); err != nil || len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d %v", len(records), err)
+	}
+
+	r := WALRecord{Kind: WALCancel, Data: models.Data{TransactionId: "w-2"}}
+	if err := w.Write(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Seq != 4 {
+		t.Fatalf("expected seq 4, got %d", r.Seq)
+	}
+
+	w.Close()
+
+	// process crashed while writing last line
+	segments, _ := filepath.Glob(path + ".*")
+	if len(segments) != 1 {
+		t.Fatalf("expected 1 segment, got %v", segments)
+	}
+
+	f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":5,"kind":"transac`)
+	f.Close()
+
+	w, err = OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	records, err := w.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 4 || records[0].Seq != 1 || records[3].Kind != WALCancel {
+		t.Fatalf("unexpected records after reopen %+v", records)
+	}
+
+	if records[1].Data.TransactionId != "w-2" || records[1].Data.Amount != 1015 || *records[1].Balance != 1015 {
+		t.Fatalf("record data not restored %+v", records[1])
+	}
+
+	// new records continue sequence in new segment. broken line of old segment skipped
+	r = WALRecord{Kind: WALTransaction, Data: models.Data{TransactionId: "w-5"}}
+	if err := w.Write(&r); err != nil || r.Seq != 5 {
+		t.Fatalf("expected seq 5, got %d %v", r.Seq, err)
+	}
+
+	if records, err = w.Records(); err != nil || len(records) != 5 {
+		t.Fatalf("expected 5 records, got %d %v", len(records), err)
+	}
+
+	// old segment saved. removed, active segment kept
+	if err := w.Compact(4); err != nil {
+		t.Fatal(err)
+	}
+
+	if records, err = w.Records(); err != nil || len(records) != 1 || records[0].Seq != 5 {
+		t.Fatalf("expected only record 5, got %+v %v", records, err)
+	}
+}
+
+// active segment rotated by size. segments removed only when all records saved
+func TestWAL_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transactions.wal")
+
+	w, err := OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SegmentSize = 1
+
+	for _, id := range []string{"r-1", "r-2", "r-3"} {
+		r := WALRecord{Kind: WALTransaction, Data: models.Data{TransactionId: id}}
+		if err := w.Write(&r); err != nil {
+			t.Fatal(err)
+		}
+
+		// record 2 not saved yet
+		if err := w.Compact(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := w.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 || records[0].Seq != 2 || records[1].Seq != 3 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+
+	if err := w.Compact(3); err != nil {
+		t.Fatal(err)
+	}
+
+	if records, err = w.Records(); err != nil || len(records) != 0 {
+		t.Fatalf("expected empty log, got %+v %v", records, err)
+	}
+
+	if segments, _ := filepath.Glob(path + ".*"); len(segments) != 1 {
+		t.Fatalf("expected only active segment, got %v", segments)
+	}
+}
+
+// log file written before segments replayed as first segment
+func TestWAL_Legacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transactions.wal")
+
+	line, _ := json.Marshal(WALRecord{Seq: 7, Kind: WALTransaction, Data: models.Data{TransactionId: "l-1", Amount: 1015}})
+	if err := os.WriteFile(path, append(line, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := OpenWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	records, err := w.Records()
+	if err != nil || len(records) != 1 || records[0].Seq != 7 || records[0].Data.Amount != 1015 {
+		t.Fatalf("legacy log not replayed %+v %v", records, err)
+	}
+
+	if w.Seq() != 7 {
+		t.Fatalf("expected seq 7, got %d", w.Seq())
+	}
+}
+
+// negative balances of allowed negative source types and cancels restored from log
+func TestWAL_NegativeBalance(t *testing.T) {
+	w, err := OpenWAL(filepath.Join(t.TempDir(), "transactions.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	balance := models.Money(-250)
+	cancel := models.Cancellation{TransactionId: "n-1", Amount: 500, BalanceBefore: 250, BalanceAfter: -250}
+	r := WALRecord{Kind: WALCancel, Data: models.Data{TransactionId: "n-1", Amount: 500, Balance: -50}, Balance: &balance, Cancel: &cancel}
+	if err := w.Write(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := w.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %+v", records)
+	}
+
+	got := records[0]
+	if got.Data.TransactionId != "n-1" || got.Data.Amount != 500 || got.Data.Balance != -50 || *got.Balance != -250 ||
+		got.Cancel.TransactionId != "n-1" || got.Cancel.Amount != 500 || got.Cancel.BalanceBefore != 250 || got.Cancel.BalanceAfter != -250 {
+		t.Fatalf("record not restored %+v %+v", got, got.Cancel)
+	}
+}